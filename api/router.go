@@ -1,20 +1,54 @@
 package handler
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/bits"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type GameStatus string
 
 const (
 	StatusPre  GameStatus = "PreGame"
+	StatusLive GameStatus = "InProgress" // started, awaiting a result; see statusFor
 	StatusDone GameStatus = "Settled"
+	StatusVoid GameStatus = "Void" // cancelled without a result
 )
 
 type Selection string
@@ -23,8 +57,95 @@ const (
 	SelHome Selection = "home"
 	SelAway Selection = "away"
 	SelDraw Selection = "draw"
+
+	// SelOver and SelUnder back the over/under market, offered on games
+	// with a totals line.
+	SelOver  Selection = "over"
+	SelUnder Selection = "under"
 )
 
+// isValidSelection reports whether sel is one of the selections above.
+func isValidSelection(sel Selection) bool {
+	switch sel {
+	case SelHome, SelAway, SelDraw, SelOver, SelUnder:
+		return true
+	}
+	return false
+}
+
+// isResult reports whether sel can be entered as a game's result.
+func isResult(sel Selection) bool {
+	return isValidSelection(sel) && !sel.isTotals()
+}
+
+// isTotals reports whether sel belongs to the over/under market rather than
+// the match winner market.
+func (sel Selection) isTotals() bool {
+	return sel == SelOver || sel == SelUnder
+}
+
+// Tokens is an amount of tokens, counted in whole millitokens so that
+// fractional stakes such as 2.5 add up exactly. In JSON it is a plain
+// decimal number (10, 2.5) and may also be sent as a string ("2.5").
+type Tokens int64
+
+// tokenScale is the number of millitokens in a token.
+const tokenScale = 1000
+
+// parseTokens reads a decimal amount such as "10", "2.5" or "-0.125". It
+// rejects more than three decimal places rather than round them away.
+func parseTokens(s string) (Tokens, error) {
+	neg := strings.HasPrefix(s, "-")
+	whole, frac, _ := strings.Cut(strings.TrimPrefix(s, "-"), ".")
+	if whole == "" && frac == "" || len(whole) > 15 || len(frac) > 3 {
+		return 0, fmt.Errorf("bad_amount")
+	}
+	for _, r := range whole + frac {
+		if r < '0' || r > '9' {
+			return 0, fmt.Errorf("bad_amount")
+		}
+	}
+	frac += strings.Repeat("0", 3-len(frac))
+	n, _ := strconv.ParseInt("0"+whole+frac, 10, 64)
+	if neg {
+		n = -n
+	}
+	return Tokens(n), nil
+}
+
+// String formats t as a decimal with no trailing zeros, e.g. "2.5".
+func (t Tokens) String() string {
+	sign := ""
+	if t < 0 {
+		sign, t = "-", -t
+	}
+	whole, frac := int64(t/tokenScale), int64(t%tokenScale)
+	if frac == 0 {
+		return sign + strconv.FormatInt(whole, 10)
+	}
+	return sign + strconv.FormatInt(whole, 10) + "." + strings.TrimRight(fmt.Sprintf("%03d", frac), "0")
+}
+
+func (t Tokens) MarshalJSON() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *Tokens) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if s == "null" {
+		return nil
+	}
+	if unq, err := strconv.Unquote(s); err == nil {
+		s = unq
+	}
+	v, err := parseTokens(s)
+	if err != nil {
+		return err
+	}
+	*t = v
+	return nil
+}
+
 type Game struct {
 	ID        int64      `json:"id"`
 	Sport     string     `json:"sport"`
@@ -33,13 +154,99 @@ type Game struct {
 	StartTime string     `json:"start_time"`
 	Status    GameStatus `json:"status"`
 	Result    *Selection `json:"result,omitempty"`
+	Score     *Score     `json:"score,omitempty"`
+	MinStake  Tokens     `json:"min_stake_tokens"`
+	AllowDraw bool       `json:"allow_draw"`
+
+	// MaxPoolShare caps the fraction of its market's total that any one
+	// outcome's pool may reach, so a single large bet can't swamp the odds.
+	// 1 disables the cap.
+	MaxPoolShare float64 `json:"max_pool_share"`
+
+	// MaxPoolTotal caps the combined pools of all the game's markets, and
+	// with them the operator's total liability on it. 0 means no cap.
+	MaxPoolTotal Tokens `json:"max_pool_total_tokens"`
 
-	HomePool int64   `json:"home_pool_tokens"`
-	AwayPool int64   `json:"away_pool_tokens"`
-	DrawPool int64   `json:"draw_pool_tokens"`
+	// MaxOdds caps what a winning bet is paid at MaxOdds times its stake;
+	// the house keeps anything over that. 0 means no cap.
+	MaxOdds float64 `json:"max_odds"`
+
+	// FixedOdds games are priced by the operator instead of by their
+	// pools: a bet locks in the Fixed*Odds of its selection when placed,
+	// and a winner is paid its stake times that multiple out of house
+	// funds. Stakes still show in the pools but don't set the payouts.
+	FixedOdds     bool    `json:"fixed_odds"`
+	FixedHomeOdds float64 `json:"fixed_home_odds,omitempty"`
+	FixedAwayOdds float64 `json:"fixed_away_odds,omitempty"`
+	FixedDrawOdds float64 `json:"fixed_draw_odds,omitempty"`
+
+	// CappedTokens is how much MaxOdds held back from the winners when the
+	// game settled.
+	CappedTokens Tokens `json:"capped_tokens,omitempty"`
+
+	// CancelledAt is when a voided game was cancelled.
+	CancelledAt string `json:"cancelled_at,omitempty"`
+
+	// ReopenedAt is when a voided game was last reopened. The stale
+	// sweeper counts its grace period from then rather than from the
+	// start time, so a game it voided too early isn't voided again
+	// straight away.
+	ReopenedAt string `json:"reopened_at,omitempty"`
+
+	// SettledAt is when the game was first settled. A later correction of
+	// its result leaves it alone.
+	SettledAt string `json:"settled_at,omitempty"`
+
+	// BettingOpen is cleared while an admin has suspended betting on the
+	// game. Bets already placed, and settlement, are unaffected.
+	BettingOpen bool `json:"betting_open"`
+
+	// FeaturedRank, when positive, lists the game ahead of unfeatured
+	// ones, lowest rank first; see setFeaturedRank.
+	FeaturedRank int `json:"featured_rank,omitempty"`
+
+	HomePool Tokens  `json:"home_pool_tokens"`
+	AwayPool Tokens  `json:"away_pool_tokens"`
+	DrawPool Tokens  `json:"draw_pool_tokens"`
 	HomeOdds float64 `json:"home_odds"`
 	AwayOdds float64 `json:"away_odds"`
 	DrawOdds float64 `json:"draw_odds"`
+	HomeProb float64 `json:"home_prob"`
+	AwayProb float64 `json:"away_prob"`
+	DrawProb float64 `json:"draw_prob"`
+
+	HomePoolShare float64 `json:"home_pool_share"`
+	AwayPoolShare float64 `json:"away_pool_share"`
+	DrawPoolShare float64 `json:"draw_pool_share"`
+
+	// HomeImplied, AwayImplied and DrawImplied are the implied
+	// probabilities with the margin taken out: scaled to sum to 1 over the
+	// outcomes that have a price, or all 0 while none does.
+	HomeImplied float64 `json:"home_implied"`
+	AwayImplied float64 `json:"away_implied"`
+	DrawImplied float64 `json:"draw_implied"`
+
+	// The over/under market is opt-in: it is offered only when TotalsLine
+	// is set, and TotalPoints is the score entered at settlement.
+	TotalsLine  float64  `json:"totals_line"`
+	TotalPoints *float64 `json:"total_points,omitempty"`
+	OverPool    Tokens   `json:"over_pool_tokens"`
+	UnderPool   Tokens   `json:"under_pool_tokens"`
+	OverOdds    float64  `json:"over_odds"`
+	UnderOdds   float64  `json:"under_odds"`
+	OverProb    float64  `json:"over_prob"`
+	UnderProb   float64  `json:"under_prob"`
+
+	TotalPool Tokens `json:"total_pool_tokens"`
+	BetCount  int    `json:"bet_count"`
+
+	// American (moneyline) odds, filled in only when a client asks for
+	// ?odds_format=american.
+	HomeOddsAmerican  string `json:"home_odds_american,omitempty"`
+	AwayOddsAmerican  string `json:"away_odds_american,omitempty"`
+	DrawOddsAmerican  string `json:"draw_odds_american,omitempty"`
+	OverOddsAmerican  string `json:"over_odds_american,omitempty"`
+	UnderOddsAmerican string `json:"under_odds_american,omitempty"`
 }
 
 type Bet struct {
@@ -47,35 +254,340 @@ type Bet struct {
 	UserID    int64     `json:"user_id"`
 	GameID    int64     `json:"game_id"`
 	Selection Selection `json:"selection"`
-	Stake     int64     `json:"stake_tokens"`
+	Stake     Tokens    `json:"stake_tokens"`
 	PlacedAt  string    `json:"placed_at"`
+
+	// OddsAtPlacement is the decimal odds of Selection right after this
+	// bet joined the pool. Payouts still follow the final pool.
+	OddsAtPlacement float64 `json:"odds_at_placement"`
+
+	// Currency is left empty for the default currency so single-currency
+	// clients see the same JSON as before.
+	Currency string `json:"currency,omitempty"`
+
+	// LockedOdds is set only on fixed-odds games: the multiple of its
+	// stake the bet is paid if it wins.
+	LockedOdds float64 `json:"locked_odds,omitempty"`
+
+	// Payout and Won are filled in when the game settles. A voided game
+	// refunds every bet, so Payout equals Stake and Won stays false.
+	Payout Tokens `json:"payout_tokens"`
+	Won    bool   `json:"won"`
+
+	// ReturnedStake is set on a winning bet when stakes are reported
+	// apart from payouts (see cutRule); the bet then paid back Payout
+	// plus ReturnedStake.
+	ReturnedStake Tokens `json:"returned_stake_tokens,omitempty"`
+}
+
+// returned is everything b paid back into its wallet.
+func (b *Bet) returned() Tokens {
+	return b.Payout + b.ReturnedStake
+}
+
+// defaultCurrency is the currency held in Wallet.Balance. Any other named
+// currency (e.g. promo tokens) lives in Wallet.Balances.
+const defaultCurrency = "tokens"
+
+// Score is a game's final score, when the admin settling it gave one.
+type Score struct {
+	Home int `json:"home"`
+	Away int `json:"away"`
+}
+
+// pushed reports whether g was voided as a push: its score was a tie but it
+// had no draw market. See settleLocked.
+func (g *Game) pushed() bool {
+	return g.Status == StatusVoid && g.Score != nil && g.Score.result() == SelDraw
+}
+
+// result is the selection the score settles a game as.
+func (sc Score) result() Selection {
+	switch {
+	case sc.Home > sc.Away:
+		return SelHome
+	case sc.Away > sc.Home:
+		return SelAway
+	}
+	return SelDraw
 }
 
 type Wallet struct {
-	UserID  int64 `json:"user_id"`
-	Balance int64 `json:"tokens_balance"`
+	UserID   int64             `json:"user_id"`
+	Balance  Tokens            `json:"tokens_balance"`
+	Balances map[string]Tokens `json:"balances,omitempty"`
+
+	// Suspended wallets can't bet, deposit or take part in transfers
+	// until an admin lifts it; see setSuspended.
+	Suspended bool `json:"suspended,omitempty"`
+
+	// Currency is the label clients show for Balance. It is filled in on
+	// wallets the store hands out (see walletView), not stored.
+	Currency string `json:"currency,omitempty"`
+}
+
+func (w *Wallet) balance(currency string) Tokens {
+	if currency == defaultCurrency {
+		return w.Balance
+	}
+	return w.Balances[currency]
+}
+
+func (w *Wallet) credit(currency string, amount Tokens) {
+	if currency == defaultCurrency {
+		w.Balance += amount
+		return
+	}
+	if w.Balances == nil {
+		w.Balances = map[string]Tokens{}
+	}
+	w.Balances[currency] += amount
+}
+
+// reserve debits stake from w if its currency balance covers it, reporting
+// whether it did. Checking and debiting in one step means a wallet can't be
+// overdrawn by two bets that each saw enough funds.
+func (w *Wallet) reserve(currency string, stake Tokens) bool {
+	if w.balance(currency) < stake {
+		return false
+	}
+	w.credit(currency, -stake)
+	return true
+}
+
+// walletView is a copy of w for a response, labelled with the token symbol.
+// Callers must hold s.mu.
+func (s *store) walletView(w *Wallet) *Wallet {
+	c := w.clone()
+	c.Currency = s.tokenSymbol
+	return c
+}
+
+// clone deep-copies w so callers can't reach the store's balances map.
+func (w *Wallet) clone() *Wallet {
+	c := *w
+	if w.Balances != nil {
+		c.Balances = make(map[string]Tokens, len(w.Balances))
+		for k, v := range w.Balances {
+			c.Balances[k] = v
+		}
+	}
+	return &c
+}
+
+// normalizeCurrency maps "" to the default currency and rejects names that
+// aren't short lowercase identifiers.
+func normalizeCurrency(c string) (string, error) {
+	if c == "" {
+		return defaultCurrency, nil
+	}
+	if len(c) > 32 {
+		return "", fmt.Errorf("bad_currency")
+	}
+	for _, r := range c {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '_' {
+			return "", fmt.Errorf("bad_currency")
+		}
+	}
+	return c, nil
+}
+
+// adminRole is what an admin key may do. Each admin endpoint needs one
+// role; roleSuper stands in for any of them.
+type adminRole string
+
+const (
+	roleSettle adminRole = "settle" // settle, void, reopen, suspend and resume games
+	roleCreate adminRole = "create" // create, clone, import and feature games
+	roleAdjust adminRole = "adjust" // adjust wallet balances and suspend users
+	roleSuper  adminRole = "super"
+)
+
+func (r adminRole) valid() bool {
+	return r == roleSettle || r == roleCreate || r == roleAdjust || r == roleSuper
+}
+
+// storeConfig holds the tunables passed to newStore.
+type storeConfig struct {
+	// adminKey guards admin endpoints, with roleSuper. When empty a random
+	// key is generated and logged at startup.
+	adminKey string
+
+	// adminRoles are further admin keys, each limited to its role.
+	adminRoles map[string]adminRole
+
+	// seedDemo starts the store with demo games and a funded user 1;
+	// see seedDemo. Otherwise it starts empty.
+	seedDemo bool
+
+	// tokenSymbol is what clients call the default currency, e.g.
+	// "coins". Defaults to "tokens".
+	tokenSymbol string
+
+	// houseCut is the fraction of each settled pool retained by the
+	// house before winners are paid, in [0, 1).
+	houseCut float64
+
+	// excludeStake reports a winner's stake apart from its payout: Payout
+	// is then the winnings alone and ReturnedStake the stake given back.
+	// By default Payout includes the stake. See cutRule.
+	excludeStake bool
+
+	// minBets, when positive, is how many bets a game needs to be settled;
+	// settling one with fewer voids it instead. See settleLocked.
+	minBets int
+
+	// disableDraws turns off draw betting and settlement on every game,
+	// whatever its AllowDraw, for deployments offering only two-way
+	// markets.
+	disableDraws bool
+
+	// rounding turns winners' fractional shares into whole millitokens;
+	// see computePayouts. Defaults to roundFloor.
+	rounding roundingMode
+
+	// margin is the overround applied to displayed odds, roundOdds
+	// snaps them to betting increments and oddsDecimals (default 2) is
+	// how many decimal places they keep; see oddsConfig.
+	margin       float64
+	roundOdds    bool
+	oddsDecimals int
+
+	// maxStake caps a single bet and maxOpenBetsPerUser caps how many
+	// unsettled bets a user may hold. Zero means unlimited.
+	maxStake           Tokens
+	maxOpenBetsPerUser int
+
+	// maxSubscribers caps live odds streams per game (default 64).
+	maxSubscribers int
+
+	// maxGames caps how many games are kept in memory; see evictGames.
+	// Zero means no cap.
+	maxGames int
+
+	// tracer receives spans for requests, bets and settlements. Nil
+	// turns tracing off.
+	tracer tracer
+
+	// autoWallets lets a bet from an unknown user open a wallet for them,
+	// seeded with signupBonus tokens. When false such bets fail with
+	// user_not_found.
+	autoWallets bool
+	signupBonus Tokens
+
+	// operatorKeys let kiosk operators place bets on behalf of other
+	// users; see placeBetAs.
+	operatorKeys []string
+
+	// betsPerMinute caps bet placement per client IP. Zero means no limit.
+	betsPerMinute int
+
+	// allowedOrigins are the browser origins allowed to call the API
+	// cross-origin; "*" allows any. Same-origin requests need no entry.
+	allowedOrigins []string
+
+	// webhookURL, when set, is notified of every settled or voided game;
+	// admins can change it at runtime via POST admin/webhook.
+	webhookURL string
+
+	// snapshotPath, when set, is loaded at boot and rewritten every
+	// snapshotEvery so state survives cold starts.
+	snapshotPath  string
+	snapshotEvery time.Duration
+
+	// staleAfter, when positive, turns on a sweeper that every sweepEvery
+	// (default one minute) voids games still waiting for a result that
+	// long after their start time; see sweepStale.
+	staleAfter time.Duration
+	sweepEvery time.Duration
 }
 
 type store struct {
-	mu       sync.Mutex
+	// Methods that only read take mu with RLock, so concurrent reads
+	// don't wait on one another; anything that changes the store takes
+	// Lock.
+	mu       sync.RWMutex
 	games    map[int64]*Game
 	bets     map[int64]*Bet
 	wallets  map[int64]*Wallet
-	nextBet  int64
+	nextGame int64
 	adminKey string
+	houseCut cutRule
+	minBets  int
+	rounding roundingMode
+	odds     oddsConfig
+
+	// adminRoles maps each admin key other than adminKey to its role. It
+	// is fixed once the store is built, so reading it needs no lock.
+	adminRoles map[string]adminRole
+
+	// drawsEnabled is false when draws are turned off store-wide; see
+	// drawAllowed.
+	drawsEnabled bool
+
+	tokenSymbol string
+
+	maxStake           Tokens
+	maxOpenBetsPerUser int
+
+	autoWallets bool
+	signupBonus Tokens
+
+	// operatorKeys is the set of valid X-Operator-Key values.
+	operatorKeys map[string]bool
+
+	// allowedOrigins is the CORS allowlist; see allowCORS.
+	allowedOrigins map[string]bool
+
+	// staleAfter is how long past its start time a game may go unsettled
+	// before sweepStale voids it. Zero disables sweeping.
+	staleAfter time.Duration
+
+	// auditLog records manual admin changes, oldest first and at most
+	// maxAuditLog of them; see adjustBalance.
+	auditLog []auditEntry
+
+	// idemKeys maps "<userID>:<Idempotency-Key>" to the bet it created.
+	idemKeys map[string]int64
+
+	// maxGames, when positive, caps len(games); see evictGames.
+	maxGames int
+
+	// tracer is never nil: noopTracer stands in when none is configured.
+	tracer tracer
+
+	// subs holds the live odds streams for each game.
+	subs           map[int64]map[chan *Game]struct{}
+	maxSubscribers int
+
+	// betLimiter throttles bet placement; nil when unlimited.
+	betLimiter *rateLimiter
+
+	// hooks delivers settlement events to the configured webhook.
+	hooks *webhooks
+
+	// metrics counts activity for GET metrics.
+	metrics storeMetrics
+
+	// epoch and version make up the ETag of game responses: version
+	// counts state changes and epoch tells apart the counters of
+	// different instances and cold starts.
+	epoch   string
+	version uint64
+
+	// totalTokens is every token that should exist: wallet balances plus
+	// stakes on unsettled games. Only deposits, settlement and admin
+	// adjustments change it; see auditInvariant.
+	totalTokens Tokens
 }
 
-func newStore() *store {
-	s := &store{
-		games:    map[int64]*Game{},
-		bets:     map[int64]*Bet{},
-		wallets:  map[int64]*Wallet{},
-		nextBet:  1,
-		adminKey: "letmein",
-	}
-	now := time.Now().Add(30 * time.Minute).Format(time.RFC3339)
+// seedDemo fills a fresh store with three games starting soon and user 1
+// holding 1000 tokens, for trying the app out locally.
+func (s *store) seedDemo() {
+	now := time.Now().UTC().Add(30 * time.Minute).Format(time.RFC3339)
 
-	s.wallets[1] = &Wallet{UserID: 1, Balance: 1000}
+	s.wallets[1] = &Wallet{UserID: 1, Balance: 1000 * tokenScale}
+	s.totalTokens = 1000 * tokenScale
 
 	s.games[101] = &Game{
 		ID:        101,
@@ -84,286 +596,5909 @@ func newStore() *store {
 		Away:      "Lewis Chicks",
 		StartTime: now,
 		Status:    StatusPre,
-		HomePool:  100, AwayPool: 100, DrawPool: 0,
+		AllowDraw: true,
+		HomePool:  100 * tokenScale, AwayPool: 100 * tokenScale, DrawPool: 0,
+		MaxPoolShare: 1,
+		BettingOpen:  true,
 	}
 	s.games[102] = &Game{
 		ID:        102,
 		Sport:     "Soccer",
 		Home:      "Alumni",
 		Away:      "Dillon",
-		StartTime: time.Now().Add(90 * time.Minute).Format(time.RFC3339),
+		StartTime: time.Now().UTC().Add(90 * time.Minute).Format(time.RFC3339),
 		Status:    StatusPre,
-		HomePool:  150, AwayPool: 120, DrawPool: 30,
+		AllowDraw: true,
+		HomePool:  150 * tokenScale, AwayPool: 120 * tokenScale, DrawPool: 30 * tokenScale,
+		MaxPoolShare: 1,
+		BettingOpen:  true,
 	}
 	s.games[103] = &Game{
 		ID:        103,
 		Sport:     "Volleyball",
 		Home:      "Cat Food",
 		Away:      "Kiss My Ace",
-		StartTime: time.Now().Add(90 * time.Minute).Format(time.RFC3339),
+		StartTime: time.Now().UTC().Add(90 * time.Minute).Format(time.RFC3339),
 		Status:    StatusPre,
-		HomePool:  150, AwayPool: 120, DrawPool: 30,
+		AllowDraw: true,
+		HomePool:  150 * tokenScale, AwayPool: 120 * tokenScale, DrawPool: 30 * tokenScale,
+		MaxPoolShare: 1,
+		BettingOpen:  true,
 	}
-	return s
-}
-
-func (s *store) listGames() []*Game {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	out := make([]*Game, 0, len(s.games))
-	for _, g := range s.games {
-		copy := *g
-		addOdds(&copy)
-		out = append(out, &copy)
+	for id := range s.games {
+		s.nextGame = max(s.nextGame, id+1)
 	}
-	return out
 }
 
-func (s *store) getGame(id int64) (*Game, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	g, ok := s.games[id]
-	if !ok {
-		return nil, false
+func newStore(cfg storeConfig) *store {
+	if cfg.houseCut < 0 || cfg.houseCut >= 1 {
+		cfg.houseCut = 0
 	}
-	copy := *g
-	addOdds(&copy)
-	return &copy, true
-}
+	if cfg.margin < 0 {
+		cfg.margin = 0
+	}
+	if !cfg.rounding.valid() {
+		cfg.rounding = roundFloor
+	}
+	if cfg.adminKey == "" {
+		// Only a fingerprint goes to the logs, which outlive the process
+		// and are readable by more people than should hold the key; demo
+		// setups get the key itself on stderr, once.
+		cfg.adminKey = randomKey()
+		log.Printf("config: ADMIN_KEY not set, using a generated admin key (fingerprint %s)", keyFingerprint(cfg.adminKey))
+		if cfg.seedDemo {
+			fmt.Fprintf(os.Stderr, "demo admin key: %s\n", cfg.adminKey)
+		}
+	}
+	s := &store{
+		adminRoles: map[string]adminRole{},
 
-func (s *store) placeBet(userID, gameID int64, sel Selection, stake int64) (*Bet, *Wallet, *Game, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+		games:    map[int64]*Game{},
+		bets:     map[int64]*Bet{},
+		wallets:  map[int64]*Wallet{},
+		idemKeys: map[string]int64{},
+		subs:     map[int64]map[chan *Game]struct{}{},
+		nextGame: 1,
+		adminKey: cfg.adminKey,
+		houseCut: cutRule{rate: cfg.houseCut, stakeInReturn: !cfg.excludeStake},
+		minBets:  cfg.minBets,
+		rounding: cfg.rounding,
+		odds:     oddsConfig{margin: cfg.margin, roundOdds: cfg.roundOdds, decimals: cfg.oddsDecimals},
 
-	w, ok := s.wallets[userID]
-	if !ok {
-		return nil, nil, nil, fmt.Errorf("user_not_found")
+		drawsEnabled: !cfg.disableDraws,
+		tokenSymbol:  cfg.tokenSymbol,
+
+		maxStake:           cfg.maxStake,
+		maxOpenBetsPerUser: cfg.maxOpenBetsPerUser,
+		maxSubscribers:     cfg.maxSubscribers,
+		maxGames:           max(cfg.maxGames, 0),
+		tracer:             cfg.tracer,
+
+		autoWallets: cfg.autoWallets,
+		signupBonus: max(cfg.signupBonus, 0),
+
+		operatorKeys:   map[string]bool{},
+		allowedOrigins: map[string]bool{},
+		staleAfter:     max(cfg.staleAfter, 0),
 	}
-	if stake <= 0 {
-		return nil, nil, nil, fmt.Errorf("bad_stake")
+	for _, o := range cfg.allowedOrigins {
+		if o = strings.TrimSuffix(strings.TrimSpace(o), "/"); o != "" {
+			s.allowedOrigins[o] = true
+		}
 	}
-	if w.Balance < stake {
-		return nil, nil, nil, fmt.Errorf("insufficient_balance")
+	for k, role := range cfg.adminRoles {
+		if k != "" && role.valid() {
+			s.adminRoles[k] = role
+		}
 	}
-	g, ok := s.games[gameID]
-	if !ok {
-		return nil, nil, nil, fmt.Errorf("game_not_found")
+	for _, k := range cfg.operatorKeys {
+		if k = strings.TrimSpace(k); k != "" {
+			s.operatorKeys[k] = true
+		}
 	}
-	if g.Status == StatusDone {
-		return nil, nil, nil, fmt.Errorf("game_settled")
+	if s.maxSubscribers <= 0 {
+		s.maxSubscribers = 64
 	}
-
-	w.Balance -= stake
-	switch sel {
-	case SelHome:
-		g.HomePool += stake
-	case SelAway:
-		g.AwayPool += stake
-	case SelDraw:
-		g.DrawPool += stake
-	default:
-		return nil, nil, nil, fmt.Errorf("bad_selection")
+	if s.tracer == nil {
+		s.tracer = noopTracer{}
+	}
+	if s.odds.decimals <= 0 {
+		s.odds.decimals = 2
+	}
+	if s.tokenSymbol == "" {
+		s.tokenSymbol = defaultCurrency
+	}
+	if cfg.betsPerMinute > 0 {
+		s.betLimiter = newRateLimiter(cfg.betsPerMinute, time.Minute)
+	}
+	s.hooks = newWebhooks(cfg.webhookURL, cfg.adminKey)
+	s.epoch = randomKey()[:8]
+	if cfg.seedDemo {
+		s.seedDemo()
 	}
 
-	b := &Bet{
-		ID:        s.nextBet,
-		UserID:    userID,
-		GameID:    gameID,
-		Selection: sel,
-		Stake:     stake,
-		PlacedAt:  time.Now().Format(time.RFC3339),
+	if cfg.snapshotPath != "" {
+		if f, err := os.Open(cfg.snapshotPath); err == nil {
+			if err := s.restore(f); err != nil {
+				log.Printf("snapshot: restore %s: %v", cfg.snapshotPath, err)
+			}
+			f.Close()
+		} else if !os.IsNotExist(err) {
+			log.Printf("snapshot: open %s: %v", cfg.snapshotPath, err)
+		}
+		if cfg.snapshotEvery > 0 {
+			go s.flushEvery(cfg.snapshotPath, cfg.snapshotEvery)
+		}
 	}
-	s.bets[b.ID] = b
-	s.nextBet++
+	if s.staleAfter > 0 {
+		if cfg.sweepEvery <= 0 {
+			cfg.sweepEvery = time.Minute
+		}
+		go s.sweepEvery(cfg.sweepEvery)
+	}
+	return s
+}
 
-	return b, w, g, nil
+// lockCtx acquires s.mu like s.mu.Lock, but gives up with timeout if ctx
+// is done first. The caller must unlock only when it returns nil.
+func (s *store) lockCtx(ctx context.Context) error {
+	return acquireCtx(ctx, s.mu.Lock, s.mu.Unlock)
 }
 
-func (s *store) settle(adminKey string, gameID int64, result Selection) (*Game, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// rlockCtx is lockCtx for reading: it acquires s.mu like s.mu.RLock.
+func (s *store) rlockCtx(ctx context.Context) error {
+	return acquireCtx(ctx, s.mu.RLock, s.mu.RUnlock)
+}
 
-	if adminKey != s.adminKey {
-		return nil, fmt.Errorf("forbidden")
-	}
-	g, ok := s.games[gameID]
-	if !ok {
-		return nil, fmt.Errorf("game_not_found")
+// acquireCtx calls lock, giving up with timeout if ctx is done first; a
+// lock that arrives after that is released again with unlock.
+func acquireCtx(ctx context.Context, lock, unlock func()) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("timeout")
 	}
-	if g.Status == StatusDone {
-		return nil, fmt.Errorf("already_settled")
+	locked := make(chan struct{})
+	go func() {
+		lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		// The lock is still on its way; release it once it arrives.
+		go func() {
+			<-locked
+			unlock()
+		}()
+		return fmt.Errorf("timeout")
 	}
+}
 
-	g.Status = StatusDone
-	g.Result = &result
+func (s *store) listGames() []*Game {
+	games, _ := s.listGamesFiltered(gameFilter{})
+	return games
+}
 
-	total := g.HomePool + g.AwayPool + g.DrawPool
-	var winnerPool int64
-	switch result {
-	case SelHome:
-		winnerPool = g.HomePool
-	case SelAway:
-		winnerPool = g.AwayPool
-	case SelDraw:
-		winnerPool = g.DrawPool
+// gameFilter narrows listGamesFiltered. Zero values match everything and
+// a limit <= 0 means no limit.
+type gameFilter struct {
+	sport  string
+	status GameStatus
+	limit  int
+	offset int
+
+	// from and to bound the start time, inclusive.
+	from, to time.Time
+}
+
+// listGamesFiltered returns one page of matching games, featured games first
+// by rank and then the rest by start time, along with the total number of
+// matches before paging.
+func (s *store) listGamesFiltered(f gameFilter) ([]*Game, int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	out := make([]*Game, 0, len(s.games))
+	for _, g := range s.games {
+		if f.sport != "" && !strings.EqualFold(g.Sport, f.sport) {
+			continue
+		}
+		if f.status != "" && statusFor(g, now) != f.status {
+			continue
+		}
+		// voided games are only listed when asked for by status
+		if f.status == "" && g.Status == StatusVoid {
+			continue
+		}
+		if !f.from.IsZero() || !f.to.IsZero() {
+			start, err := parseStartTime(g.StartTime)
+			if err != nil || !f.from.IsZero() && start.Before(f.from) || !f.to.IsZero() && start.After(f.to) {
+				continue
+			}
+		}
+		out = append(out, s.gameView(g))
 	}
-	if winnerPool == 0 {
-		return g, nil
+	sort.Slice(out, func(i, j int) bool {
+		if ri, rj := out[i].FeaturedRank, out[j].FeaturedRank; ri != rj {
+			switch {
+			case ri == 0:
+				return false
+			case rj == 0:
+				return true
+			}
+			return ri < rj
+		}
+		ti, _ := parseStartTime(out[i].StartTime)
+		tj, _ := parseStartTime(out[j].StartTime)
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return out[i].ID < out[j].ID
+	})
+
+	total := len(out)
+	out = out[min(f.offset, total):]
+	if f.limit > 0 && f.limit < len(out) {
+		out = out[:f.limit]
 	}
-	for _, b := range s.bets {
-		if b.GameID != gameID {
+	return out, total
+}
+
+// results returns the settled games, optionally only those in sport, in the
+// order they settled.
+func (s *store) results(sport string) []*Game {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := []*Game{}
+	for _, g := range s.games {
+		if g.Status != StatusDone {
 			continue
 		}
-		if b.Selection == result {
-			share := float64(b.Stake) / float64(winnerPool)
-			payout := int64(share * float64(total))
-			w := s.wallets[b.UserID]
-			w.Balance += payout
+		if sport != "" && !strings.EqualFold(g.Sport, sport) {
+			continue
 		}
+		out = append(out, s.gameView(g))
 	}
-	return g, nil
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].SettledAt != out[j].SettledAt {
+			return out[i].SettledAt < out[j].SettledAt
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
 }
 
-func addOdds(g *Game) {
-	total := float64(g.HomePool + g.AwayPool + g.DrawPool)
-	if total <= 0 {
-		g.HomeOdds, g.AwayOdds, g.DrawOdds = 0, 0, 0
-		return
+func (s *store) getGame(id int64) (*Game, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	g, ok := s.games[id]
+	if !ok {
+		return nil, false
 	}
-	g.HomeOdds = float64(g.HomePool) / total
-	g.AwayOdds = float64(g.AwayPool) / total
-	g.DrawOdds = float64(g.DrawPool) / total
+	return s.gameView(g), true
 }
 
-var st = newStore()
+// getGames looks up each of ids, read together so the games agree with
+// each other. It returns those found, in the order asked for, and the IDs
+// that weren't.
+func (s *store) getGames(ids []int64) (games []*Game, missing []int64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	games, missing = []*Game{}, []int64{}
+	for _, id := range ids {
+		if g, ok := s.games[id]; ok {
+			games = append(games, s.gameView(g))
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	return games, missing
+}
 
-// ---------------- Vercel entry (single function) ----------------
+// userPosition is one user's bets on a game and their stake on each
+// selection, for showing alongside the game's odds.
+type userPosition struct {
+	UserID           int64                `json:"user_id"`
+	Bets             []*Bet               `json:"bets"`
+	StakeBySelection map[Selection]Tokens `json:"stake_by_selection"`
+	TotalStake       Tokens               `json:"total_stake_tokens"`
+}
+
+// getGameFor is getGame plus userID's position on the game, read together
+// so the two agree.
+func (s *store) getGameFor(id, userID int64) (*Game, *userPosition, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	g, ok := s.games[id]
+	if !ok {
+		return nil, nil, false
+	}
+	pos := &userPosition{UserID: userID, Bets: []*Bet{}, StakeBySelection: map[Selection]Tokens{}}
+	for _, b := range s.bets {
+		if b.GameID != id || b.UserID != userID {
+			continue
+		}
+		copy := *b
+		pos.Bets = append(pos.Bets, &copy)
+		pos.StakeBySelection[b.Selection] += b.Stake
+		pos.TotalStake += b.Stake
+	}
+	sort.Slice(pos.Bets, func(i, j int) bool {
+		if pos.Bets[i].PlacedAt != pos.Bets[j].PlacedAt {
+			return pos.Bets[i].PlacedAt < pos.Bets[j].PlacedAt
+		}
+		return pos.Bets[i].ID < pos.Bets[j].ID
+	})
+	return s.gameView(g), pos, true
+}
+
+// etag identifies the current state of the store for conditional GETs.
+// Read it before the data it describes, so a change that lands in between
+// makes the tag stale rather than the response.
+//
+// Games also change as seen by clients when they start, with no write to
+// bump the version, so the tag counts the games then StatusLive too. Only
+// a write can take a game out of StatusLive, so the count can't come back
+// to an earlier value without the version moving on.
+func (s *store) etag() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now, live := time.Now(), 0
+	for _, g := range s.games {
+		if statusFor(g, now) == StatusLive {
+			live++
+		}
+	}
+	return fmt.Sprintf(`"%s-%d-%d"`, s.epoch, s.version, live)
+}
+
+// gameView returns a priced copy of g with its bet count filled in, safe to
+// hand out after s.mu is released. Callers must hold s.mu.
+func (s *store) gameView(g *Game) *Game {
+	copy := *g
+	copy.Status = statusFor(g, time.Now())
+	copy.AllowDraw = s.drawAllowed(g)
+	addOdds(&copy, s.odds)
+	copy.BetCount = s.betCount(g.ID)
+	return &copy
+}
+
+// isAdmin reports whether key is any admin's key.
+func (s *store) isAdmin(key string) bool {
+	return key != "" && (key == s.adminKey || s.adminRoles[key] != "")
+}
+
+// hasRole reports whether key is an admin key allowed to act as role.
+func (s *store) hasRole(key string, role adminRole) bool {
+	if key == "" {
+		return false
+	}
+	if key == s.adminKey {
+		return true
+	}
+	r := s.adminRoles[key]
+	return r == role || r == roleSuper
+}
+
+// drawAllowed reports whether g can be bet on, and settled, as a draw: it
+// must allow draws itself and draws must not be turned off store-wide.
+func (s *store) drawAllowed(g *Game) bool {
+	return s.drawsEnabled && g.AllowDraw
+}
+
+// betCount returns how many bets are on gameID. Callers must hold s.mu.
+func (s *store) betCount(gameID int64) int {
+	n := 0
+	for _, b := range s.bets {
+		if b.GameID == gameID {
+			n++
+		}
+	}
+	return n
+}
+
+// gameSpec is the admin-supplied description of a new game.
+type gameSpec struct {
+	Sport     string         `json:"sport"`
+	Home      string         `json:"home"`
+	Away      string         `json:"away"`
+	StartTime stringOrNumber `json:"start_time"` // see parseStartTime
+	MinStake  Tokens         `json:"min_stake"`
+	AllowDraw *bool          `json:"allow_draw"` // defaults to true
+
+	TotalsLine float64 `json:"totals_line"` // 0 means no over/under market
+
+	MaxPoolShare float64 `json:"max_pool_share"` // 0 means 1, i.e. no cap
+	MaxPoolTotal Tokens  `json:"max_pool_total"` // 0 means no cap
+	MaxOdds      float64 `json:"max_odds"`       // 0 means no cap
+
+	// FixedOdds turns on fixed-odds betting; the odds of each selection
+	// must then be over 1 (draw only if draws are allowed).
+	FixedOdds     bool    `json:"fixed_odds"`
+	FixedHomeOdds float64 `json:"fixed_home_odds"`
+	FixedAwayOdds float64 `json:"fixed_away_odds"`
+	FixedDrawOdds float64 `json:"fixed_draw_odds"`
+}
+
+// maxNameRunes caps the length of sport and team names.
+const maxNameRunes = 100
+
+// cleanName trims a sport or team name and collapses each run of spaces
+// inside it to one. It reports false if the name holds a control character,
+// such as a tab, or is longer than maxNameRunes.
+func cleanName(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return "", false
+	}
+	name = strings.Join(strings.Fields(name), " ")
+	return name, utf8.RuneCountInString(name) <= maxNameRunes
+}
+
+func (s *store) createGame(adminKey string, spec gameSpec) (*Game, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.hasRole(adminKey, roleCreate) {
+		return nil, fmt.Errorf("forbidden")
+	}
+	sport, okSport := cleanName(spec.Sport)
+	home, okHome := cleanName(spec.Home)
+	away, okAway := cleanName(spec.Away)
+	if !okSport || !okHome || !okAway {
+		return nil, fmt.Errorf("invalid_name")
+	}
+	if sport == "" {
+		return nil, fmt.Errorf("bad_sport")
+	}
+	if home == "" || away == "" {
+		return nil, fmt.Errorf("bad_team_name")
+	}
+	start, err := parseStartTime(string(spec.StartTime))
+	if err != nil {
+		return nil, err
+	}
+	if !start.After(time.Now()) {
+		return nil, fmt.Errorf("bad_start_time")
+	}
+	if spec.MinStake < 0 {
+		return nil, fmt.Errorf("bad_min_stake")
+	}
+	if spec.TotalsLine < 0 {
+		return nil, fmt.Errorf("bad_totals_line")
+	}
+	if spec.MaxPoolShare == 0 {
+		spec.MaxPoolShare = 1
+	}
+	if !(spec.MaxPoolShare > 0 && spec.MaxPoolShare <= 1) {
+		return nil, fmt.Errorf("bad_max_pool_share")
+	}
+	if spec.MaxPoolTotal < 0 {
+		return nil, fmt.Errorf("bad_max_pool_total")
+	}
+	if spec.MaxOdds != 0 && !(spec.MaxOdds >= 1) {
+		return nil, fmt.Errorf("bad_max_odds")
+	}
+	allowDraw := spec.AllowDraw == nil || *spec.AllowDraw
+	if spec.FixedOdds {
+		if spec.TotalsLine != 0 {
+			return nil, fmt.Errorf("fixed_odds_totals_unsupported")
+		}
+		if !(spec.FixedHomeOdds > 1 && spec.FixedAwayOdds > 1) || (allowDraw && !(spec.FixedDrawOdds > 1)) {
+			return nil, fmt.Errorf("bad_fixed_odds")
+		}
+		if !allowDraw {
+			spec.FixedDrawOdds = 0
+		}
+	} else {
+		spec.FixedHomeOdds, spec.FixedAwayOdds, spec.FixedDrawOdds = 0, 0, 0
+	}
+
+	g := &Game{
+		ID:        s.nextGame,
+		Sport:     sport,
+		Home:      home,
+		Away:      away,
+		StartTime: start.UTC().Format(time.RFC3339),
+		Status:    StatusPre,
+		MinStake:  spec.MinStake,
+		AllowDraw: allowDraw,
+
+		TotalsLine:   spec.TotalsLine,
+		MaxPoolShare: spec.MaxPoolShare,
+		MaxPoolTotal: spec.MaxPoolTotal,
+		MaxOdds:      spec.MaxOdds,
+		BettingOpen:  true,
+
+		FixedOdds:     spec.FixedOdds,
+		FixedHomeOdds: spec.FixedHomeOdds,
+		FixedAwayOdds: spec.FixedAwayOdds,
+		FixedDrawOdds: spec.FixedDrawOdds,
+	}
+	s.games[g.ID] = g
+	s.nextGame++
+	s.version++
+	s.evictGames()
+
+	return s.gameView(g), nil
+}
+
+// closedAt is when g was settled or voided, or the zero time if it is open.
+func (g *Game) closedAt() time.Time {
+	at := g.SettledAt
+	if at == "" {
+		at = g.CancelledAt
+	}
+	t, _ := time.Parse(time.RFC3339, at)
+	return t
+}
+
+// evictGames drops the games closed longest ago, with their bets, until
+// there are no more than s.maxGames, so memory doesn't grow without bound.
+// It is run wherever games are added (createGame, which clone and import
+// go through, and restore) and wherever one closes, since open games are
+// never evicted and the cap can be exceeded while they outnumber it. Evicted bets are already paid or refunded, so the token
+// accounting is unaffected. Callers must hold s.mu.
+func (s *store) evictGames() {
+	if s.maxGames <= 0 || len(s.games) <= s.maxGames {
+		return
+	}
+	var closed []*Game
+	for _, g := range s.games {
+		if g.closed() {
+			closed = append(closed, g)
+		}
+	}
+	sort.Slice(closed, func(i, j int) bool {
+		if ti, tj := closed[i].closedAt(), closed[j].closedAt(); !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return closed[i].ID < closed[j].ID
+	})
+	evicted := map[int64]bool{}
+	for _, g := range closed {
+		if len(s.games) <= s.maxGames {
+			break
+		}
+		delete(s.games, g.ID)
+		evicted[g.ID] = true
+	}
+	for id, b := range s.bets {
+		if evicted[b.GameID] {
+			delete(s.bets, id)
+		}
+	}
+	for k, id := range s.idemKeys {
+		if _, ok := s.bets[id]; !ok {
+			delete(s.idemKeys, k)
+		}
+	}
+}
+
+// cloneGame creates a game like gameID, e.g. for a rematch: same sport,
+// teams and market settings, but starting at startTime with empty pools and
+// no bets. It is validated like any new game.
+func (s *store) cloneGame(adminKey string, gameID int64, startTime stringOrNumber) (*Game, error) {
+	if !s.hasRole(adminKey, roleCreate) {
+		return nil, fmt.Errorf("forbidden")
+	}
+	s.mu.RLock()
+	src, ok := s.games[gameID]
+	var spec gameSpec
+	if ok {
+		allowDraw := src.AllowDraw
+		spec = gameSpec{
+			Sport:     src.Sport,
+			Home:      src.Home,
+			Away:      src.Away,
+			MinStake:  src.MinStake,
+			AllowDraw: &allowDraw,
+
+			TotalsLine:   src.TotalsLine,
+			MaxPoolShare: src.MaxPoolShare,
+			MaxPoolTotal: src.MaxPoolTotal,
+			MaxOdds:      src.MaxOdds,
+
+			FixedOdds:     src.FixedOdds,
+			FixedHomeOdds: src.FixedHomeOdds,
+			FixedAwayOdds: src.FixedAwayOdds,
+			FixedDrawOdds: src.FixedDrawOdds,
+		}
+	}
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("game_not_found")
+	}
+	spec.StartTime = startTime
+	return s.createGame(adminKey, spec)
+}
+
+func (s *store) getWallet(userID int64) (*Wallet, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	w, ok := s.wallets[userID]
+	if !ok {
+		return nil, false
+	}
+	return s.walletView(w), true
+}
+
+// topWallets returns up to limit wallets by token balance, highest first,
+// with ties going to the lower user ID.
+func (s *store) topWallets(limit int) []*Wallet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]*Wallet, 0, len(s.wallets))
+	for _, w := range s.wallets {
+		out = append(out, s.walletView(w))
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Balance != out[j].Balance {
+			return out[i].Balance > out[j].Balance
+		}
+		return out[i].UserID < out[j].UserID
+	})
+	if limit < len(out) {
+		out = out[:limit]
+	}
+	return out
+}
+
+func (s *store) getBet(id int64) (*Bet, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, ok := s.bets[id]
+	if !ok {
+		return nil, false
+	}
+	copy := *b
+	return &copy, true
+}
+
+// maxDeposit caps a single deposit.
+const maxDeposit = 1_000_000 * tokenScale
+
+// deposit adds funds in currency to a wallet, opening it first if the user
+// has none. A deposit that would take the wallet, or the store's token
+// count, past what a Tokens can hold fails with balance_overflow.
+func (s *store) deposit(userID int64, amount Tokens, currency string) (*Wallet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if amount <= 0 {
+		return nil, fmt.Errorf("bad_amount")
+	}
+	if amount > maxDeposit {
+		return nil, fmt.Errorf("amount_too_large")
+	}
+	currency, err := normalizeCurrency(currency)
+	if err != nil {
+		return nil, err
+	}
+	w := s.ensureWallet(userID)
+	if w == nil {
+		w = &Wallet{UserID: userID}
+		s.wallets[userID] = w
+	}
+	if w.Suspended {
+		return nil, fmt.Errorf("account_suspended")
+	}
+	if w.balance(currency) > math.MaxInt64-amount || s.totalTokens > math.MaxInt64-amount {
+		return nil, fmt.Errorf("balance_overflow")
+	}
+	w.credit(currency, amount)
+	s.totalTokens += amount
+	s.version++
+
+	return s.walletView(w), nil
+}
+
+// transfer moves amount tokens from one user's wallet to another's, opening
+// the recipient's wallet if they have none. Nothing changes unless the whole
+// transfer can be made.
+func (s *store) transfer(fromUserID, toUserID int64, amount Tokens) (from, to *Wallet, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if amount <= 0 {
+		return nil, nil, fmt.Errorf("bad_amount")
+	}
+	if fromUserID == toUserID {
+		return nil, nil, fmt.Errorf("self_transfer")
+	}
+	src, ok := s.wallets[fromUserID]
+	if !ok {
+		return nil, nil, fmt.Errorf("wallet_not_found")
+	}
+	if dst, ok := s.wallets[toUserID]; src.Suspended || ok && dst.Suspended {
+		return nil, nil, fmt.Errorf("account_suspended")
+	}
+	if src.Balance < amount {
+		return nil, nil, fmt.Errorf("insufficient_balance")
+	}
+	dst := s.ensureWallet(toUserID)
+	if dst == nil {
+		dst = &Wallet{UserID: toUserID}
+		s.wallets[toUserID] = dst
+	}
+	src.credit(defaultCurrency, -amount)
+	dst.credit(defaultCurrency, amount)
+	s.version++
+
+	return s.walletView(src), s.walletView(dst), nil
+}
+
+// setSuspended suspends userID's wallet, or lifts the suspension, and
+// records it in the audit log. Setting it to what it already is changes
+// nothing.
+func (s *store) setSuspended(adminKey string, userID int64, suspended bool, reason, actor string) (*Wallet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.hasRole(adminKey, roleAdjust) {
+		return nil, fmt.Errorf("forbidden")
+	}
+	w, ok := s.wallets[userID]
+	if !ok {
+		return nil, fmt.Errorf("wallet_not_found")
+	}
+	if w.Suspended == suspended {
+		return s.walletView(w), nil
+	}
+	w.Suspended = suspended
+	s.version++
+
+	action := "user_suspend"
+	if !suspended {
+		action = "user_unsuspend"
+	}
+	s.recordAudit(auditEntry{
+		Action:  action,
+		Actor:   actor,
+		UserID:  userID,
+		Balance: w.Balance,
+		Reason:  strings.TrimSpace(reason),
+	})
+	return s.walletView(w), nil
+}
+
+// maxAuditLog caps how many entries the audit log keeps; older ones are
+// dropped first.
+const maxAuditLog = 1000
+
+// auditEntry records one manual admin change: what was done, to whom, by
+// whom (the admin's client IP) and why.
+type auditEntry struct {
+	At      string `json:"at"`
+	Action  string `json:"action"`
+	Actor   string `json:"actor"`
+	UserID  int64  `json:"user_id"`
+	Delta   Tokens `json:"delta_tokens"`
+	Balance Tokens `json:"balance_tokens"` // after the change
+	Reason  string `json:"reason"`
+}
+
+// adjustBalance changes a wallet's balance by delta, e.g. to correct a bug
+// or comp a user, and records it in the audit log. It fails with
+// negative_balance rather than take a wallet below zero.
+func (s *store) adjustBalance(adminKey string, userID int64, delta Tokens, reason, actor string) (*Wallet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.hasRole(adminKey, roleAdjust) {
+		return nil, fmt.Errorf("forbidden")
+	}
+	if delta == 0 {
+		return nil, fmt.Errorf("bad_amount")
+	}
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return nil, fmt.Errorf("missing_reason")
+	}
+	w, ok := s.wallets[userID]
+	if !ok {
+		return nil, fmt.Errorf("wallet_not_found")
+	}
+	if w.Balance+delta < 0 {
+		return nil, fmt.Errorf("negative_balance")
+	}
+	w.credit(defaultCurrency, delta)
+	s.totalTokens += delta
+	s.version++
+
+	s.recordAudit(auditEntry{
+		Action:  "wallet_adjust",
+		Actor:   actor,
+		UserID:  userID,
+		Delta:   delta,
+		Balance: w.Balance,
+		Reason:  reason,
+	})
+	return s.walletView(w), nil
+}
+
+// recordAudit appends e to the audit log, stamped with the current time,
+// dropping the oldest entries past maxAuditLog. Callers must hold s.mu.
+func (s *store) recordAudit(e auditEntry) {
+	e.At = time.Now().UTC().Format(time.RFC3339)
+	s.auditLog = append(s.auditLog, e)
+	if over := len(s.auditLog) - maxAuditLog; over > 0 {
+		s.auditLog = append([]auditEntry(nil), s.auditLog[over:]...)
+	}
+}
+
+// auditEntries returns a copy of the audit log, oldest first.
+func (s *store) auditEntries() []auditEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append(make([]auditEntry, 0, len(s.auditLog)), s.auditLog...)
+}
+
+// ensureWallet returns userID's wallet, opening one with the signup bonus
+// if they have none and autoWallets is on; otherwise it returns nil.
+// Callers must hold s.mu.
+func (s *store) ensureWallet(userID int64) *Wallet {
+	w := s.walletFor(userID)
+	if w != nil {
+		s.openWallet(w)
+	}
+	return w
+}
+
+// walletFor is ensureWallet without the opening: a wallet it makes up holds
+// the signup bonus but isn't stored until passed to openWallet, so a bet
+// that is then rejected leaves no wallet, and no bonus, behind. Callers
+// must hold s.mu.
+func (s *store) walletFor(userID int64) *Wallet {
+	if w, ok := s.wallets[userID]; ok {
+		return w
+	}
+	if !s.autoWallets {
+		return nil
+	}
+	return &Wallet{UserID: userID, Balance: s.signupBonus}
+}
+
+// openWallet stores w, from walletFor, if it isn't stored already. It must
+// be called before w's balance changes. Callers must hold s.mu.
+func (s *store) openWallet(w *Wallet) {
+	if _, ok := s.wallets[w.UserID]; ok {
+		return
+	}
+	s.wallets[w.UserID] = w
+	s.totalTokens += s.signupBonus
+	s.version++
+}
+
+func (s *store) listBetsByUser(userID int64, gameID *int64) ([]*Bet, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.wallets[userID]; !ok {
+		return nil, false
+	}
+	out := make([]*Bet, 0)
+	for _, b := range s.bets {
+		if b.UserID != userID {
+			continue
+		}
+		if gameID != nil && b.GameID != *gameID {
+			continue
+		}
+		copy := *b
+		out = append(out, &copy)
+	}
+	// newest first; IDs break ties within the same second
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].PlacedAt != out[j].PlacedAt {
+			return out[i].PlacedAt > out[j].PlacedAt
+		}
+		return out[i].ID > out[j].ID
+	})
+	return out, true
+}
+
+// statsReport is a user's lifetime betting record, in the default currency.
+type statsReport struct {
+	UserID int64 `json:"user_id"`
+	Bets   int   `json:"bets"`
+
+	// StakedTokens counts every bet, open or not; cashed-out stake is
+	// not included.
+	StakedTokens   Tokens `json:"staked_tokens"`
+	WonTokens      Tokens `json:"won_tokens"`
+	RefundedTokens Tokens `json:"refunded_tokens"`
+
+	// NetTokens is the profit or loss on closed bets: what they paid back,
+	// winnings and refunds, less what was staked on them. Stakes still
+	// riding on open games are reported separately as OpenStakeTokens.
+	NetTokens       Tokens `json:"net_tokens"`
+	OpenStakeTokens Tokens `json:"open_stake_tokens"`
+}
+
+// userStats adds up userID's bets in the default currency, or returns false
+// if the user has no wallet.
+func (s *store) userStats(userID int64) (*statsReport, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.wallets[userID]; !ok {
+		return nil, false
+	}
+	rep := &statsReport{UserID: userID}
+	for _, b := range s.bets {
+		if b.UserID != userID || b.currency() != defaultCurrency {
+			continue
+		}
+		rep.Bets++
+		rep.StakedTokens += b.Stake
+		switch s.games[b.GameID].Status {
+		case StatusDone:
+			rep.WonTokens += b.returned()
+			rep.NetTokens += b.returned() - b.Stake
+		case StatusVoid:
+			rep.RefundedTokens += b.Payout
+			rep.NetTokens += b.Payout - b.Stake
+		default:
+			rep.OpenStakeTokens += b.Stake
+		}
+	}
+	return rep, true
+}
+
+// position is a user's stake in one open game.
+type position struct {
+	Game       *Game
+	Stake      Tokens
+	Selections []Selection
+}
+
+// openPositions returns the unsettled games userID has bets on, soonest
+// start first, each with the user's total stake and the selections they
+// backed. It returns false if the user has no wallet.
+func (s *store) openPositions(userID int64) ([]position, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.wallets[userID]; !ok {
+		return nil, false
+	}
+	byGame := map[int64]*position{}
+	for _, b := range s.bets {
+		g := s.games[b.GameID]
+		if b.UserID != userID || g.closed() {
+			continue
+		}
+		p, ok := byGame[g.ID]
+		if !ok {
+			p = &position{Game: s.gameView(g)}
+			byGame[g.ID] = p
+		}
+		p.Stake += b.Stake
+		if !slices.Contains(p.Selections, b.Selection) {
+			p.Selections = append(p.Selections, b.Selection)
+		}
+	}
+	out := make([]position, 0, len(byGame))
+	for _, p := range byGame {
+		sort.Slice(p.Selections, func(i, j int) bool { return p.Selections[i] < p.Selections[j] })
+		out = append(out, *p)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Game.StartTime != out[j].Game.StartTime {
+			return out[i].Game.StartTime < out[j].Game.StartTime
+		}
+		return out[i].Game.ID < out[j].Game.ID
+	})
+	return out, true
+}
+
+// listBetsByGame returns every bet on gameID in the order they were placed,
+// or false if the game doesn't exist.
+func (s *store) listBetsByGame(gameID int64) ([]*Bet, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.games[gameID]; !ok {
+		return nil, false
+	}
+	out := make([]*Bet, 0)
+	for _, b := range s.bets {
+		if b.GameID == gameID {
+			copy := *b
+			out = append(out, &copy)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].PlacedAt != out[j].PlacedAt {
+			return out[i].PlacedAt < out[j].PlacedAt
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out, true
+}
+
+// currency returns the currency b was staked (and is paid out) in.
+func (b *Bet) currency() string {
+	if b.Currency == "" {
+		return defaultCurrency
+	}
+	return b.Currency
+}
+
+// allIn is the stake placeBet reads as "the whole balance". No real stake
+// can be negative, so it can't be mistaken for one.
+const allIn Tokens = -1
+
+// placeBet stakes funds in currency ("" for the default) from userID's
+// wallet on a game outcome. All currencies share the game's pools 1:1 and
+// winnings are paid in the currency that was staked. A non-empty idemKey
+// makes the call replay-safe: repeating it returns the bet it first created
+// without charging again, and reusing it for a different bet fails with
+// idempotency_conflict. A positive minOdds is the least the bettor will
+// accept: if the bet's own stake, or bets placed since the bettor last saw
+// the odds, would leave its OddsAtPlacement below that, it fails with
+// odds_moved and nothing is charged. A stake of allIn bets the wallet's whole
+// balance in currency.
+func (s *store) placeBet(ctx context.Context, userID, gameID int64, sel Selection, stake Tokens, minOdds float64, currency, idemKey string) (_ *Bet, _ *Wallet, _ *Game, err error) {
+	ctx, sp := s.tracer.Start(ctx, "store.placeBet")
+	sp.SetAttr("game_id", gameID)
+	sp.SetAttr("outcome", string(sel))
+	defer func() { endSpan(sp, err) }()
+
+	if err := s.lockCtx(ctx); err != nil {
+		return nil, nil, nil, err
+	}
+	defer s.mu.Unlock()
+
+	w := s.walletFor(userID)
+	if w == nil {
+		return nil, nil, nil, fmt.Errorf("user_not_found")
+	}
+	if w.Suspended {
+		return nil, nil, nil, fmt.Errorf("account_suspended")
+	}
+	currency, err = normalizeCurrency(currency)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	scopedKey := ""
+	if idemKey != "" {
+		scopedKey = fmt.Sprintf("%d:%s", userID, idemKey)
+		// The bet a key points at may since have been removed (e.g. fully
+		// cashed out); the key is then free to be used again.
+		if b, ok := s.bets[s.idemKeys[scopedKey]]; ok {
+			if b.GameID != gameID || b.Selection != sel || (stake != allIn && b.Stake != stake) || b.currency() != currency {
+				return nil, nil, nil, fmt.Errorf("idempotency_conflict")
+			}
+			copy := *b
+			return &copy, s.walletView(w), s.gameView(s.games[gameID]), nil
+		}
+	}
+	if minOdds < 0 {
+		return nil, nil, nil, fmt.Errorf("bad_min_odds")
+	}
+	if stake == allIn {
+		if stake = w.balance(currency); stake <= 0 {
+			return nil, nil, nil, fmt.Errorf("insufficient_balance")
+		}
+	}
+	g := s.games[gameID]
+	if err := s.checkBet(userID, g, sel, stake, 0); err != nil {
+		return nil, nil, nil, err
+	}
+	if minOdds > 0 {
+		trial := *g
+		trial.addStake(sel, stake)
+		addOdds(&trial, s.odds)
+		if trial.oddsFor(sel) < minOdds {
+			return nil, nil, nil, fmt.Errorf("odds_moved")
+		}
+	}
+
+	if w.balance(currency) < stake {
+		return nil, nil, nil, fmt.Errorf("insufficient_balance")
+	}
+
+	// Everything that can reject the bet has been checked, so from here on
+	// it is placed in full: a new user's wallet is opened, the stake is
+	// reserved from it and added to the pool under the same hold of s.mu,
+	// and nothing below fails.
+	s.openWallet(w)
+	w.reserve(currency, stake)
+	b := s.addBet(userID, g, sel, stake, currency)
+	if scopedKey != "" {
+		s.idemKeys[scopedKey] = b.ID
+	}
+	s.version++
+
+	s.publish(g)
+
+	// Hand back a copy: settling or cashing out writes to the stored bet
+	// once s.mu is released, while the caller is still encoding this one.
+	copy := *b
+	return &copy, s.walletView(w), s.gameView(g), nil
+}
+
+// checkBet reports why userID staking stake on sel in g (nil if there is
+// no such game) would be rejected, if it would. pending counts open bets
+// the user is about to place alongside this one. The wallet is left to
+// the caller. Callers must hold s.mu.
+func (s *store) checkBet(userID int64, g *Game, sel Selection, stake Tokens, pending int) error {
+	if !isValidSelection(sel) {
+		return fmt.Errorf("bad_selection")
+	}
+	if stake <= 0 {
+		return fmt.Errorf("bad_stake")
+	}
+	if s.maxStake > 0 && stake > s.maxStake {
+		return fmt.Errorf("stake_too_large")
+	}
+	if s.maxOpenBetsPerUser > 0 && s.openBetCount(userID)+pending >= s.maxOpenBetsPerUser {
+		return fmt.Errorf("too_many_open_bets")
+	}
+	if g == nil {
+		return fmt.Errorf("game_not_found")
+	}
+	if g.closed() {
+		return fmt.Errorf("game_settled")
+	}
+	if statusFor(g, time.Now()) == StatusLive {
+		return fmt.Errorf("game_started")
+	}
+	if !g.BettingOpen {
+		return fmt.Errorf("betting_suspended")
+	}
+	if stake < g.MinStake {
+		return fmt.Errorf("stake_below_minimum")
+	}
+
+	if sel == SelDraw && !s.drawAllowed(g) {
+		return fmt.Errorf("draw_not_allowed")
+	}
+	if sel.isTotals() && g.TotalsLine == 0 {
+		return fmt.Errorf("totals_not_offered")
+	}
+	if g.breachesPoolShare(sel, stake) {
+		return fmt.Errorf("pool_imbalance")
+	}
+	if g.MaxPoolTotal > 0 && g.poolTotal()+stake > g.MaxPoolTotal {
+		return fmt.Errorf("pool_full")
+	}
+	return nil
+}
+
+// addBet puts stake on sel into g's pool and records the bet. The bet must
+// already have passed checkBet and its stake been reserved from the
+// wallet. Callers must hold s.mu.
+func (s *store) addBet(userID int64, g *Game, sel Selection, stake Tokens, currency string) *Bet {
+	g.addStake(sel, stake)
+	priced := *g
+	addOdds(&priced, s.odds)
+	b := &Bet{
+		ID:        s.newBetID(),
+		UserID:    userID,
+		GameID:    g.ID,
+		Selection: sel,
+		Stake:     stake,
+		PlacedAt:  time.Now().Format(time.RFC3339),
+
+		OddsAtPlacement: priced.oddsFor(sel),
+	}
+	if g.FixedOdds {
+		b.LockedOdds = g.fixedOddsFor(sel)
+	}
+	if currency != defaultCurrency {
+		b.Currency = currency
+	}
+	s.bets[b.ID] = b
+	s.metrics.betsPlaced.Add(1)
+	s.metrics.stakeVolume.Add(int64(stake))
+	return b
+}
+
+// maxSlipBets caps how many bets one bet slip may hold.
+const maxSlipBets = 20
+
+// slipBet is one bet on a bet slip.
+type slipBet struct {
+	GameID    int64     `json:"game_id"`
+	Selection Selection `json:"selection"`
+	Stake     Tokens    `json:"stake"`
+}
+
+// placeBetSlip places all of slip for userID, in the default currency, or
+// none of it. Every bet is checked first, in order and as though the ones
+// before it had been placed, under one hold of s.mu; if any fails the slip
+// is rejected with slip_rejected and the reasons are returned by index.
+func (s *store) placeBetSlip(ctx context.Context, userID int64, slip []slipBet) ([]*Bet, *Wallet, map[int]string, error) {
+	if len(slip) == 0 {
+		return nil, nil, nil, fmt.Errorf("empty_slip")
+	}
+	if len(slip) > maxSlipBets {
+		return nil, nil, nil, fmt.Errorf("slip_too_large")
+	}
+	if err := s.lockCtx(ctx); err != nil {
+		return nil, nil, nil, err
+	}
+	defer s.mu.Unlock()
+
+	w := s.walletFor(userID)
+	if w == nil {
+		return nil, nil, nil, fmt.Errorf("user_not_found")
+	}
+	if w.Suspended {
+		return nil, nil, nil, fmt.Errorf("account_suspended")
+	}
+
+	// Check against copies of the games so earlier bets on the slip count
+	// towards the pool limits of later ones.
+	games := map[int64]*Game{}
+	var staked Tokens
+	pending := 0
+	failed := map[int]string{}
+	for i, sb := range slip {
+		g, ok := games[sb.GameID]
+		if orig := s.games[sb.GameID]; !ok && orig != nil {
+			copy := *orig
+			g, games[sb.GameID] = &copy, &copy
+		}
+		if err := s.checkBet(userID, g, sb.Selection, sb.Stake, pending); err != nil {
+			failed[i] = err.Error()
+			continue
+		}
+		if staked+sb.Stake > w.balance(defaultCurrency) {
+			failed[i] = "insufficient_balance"
+			continue
+		}
+		g.addStake(sb.Selection, sb.Stake)
+		staked += sb.Stake
+		pending++
+	}
+	if len(failed) > 0 {
+		return nil, nil, failed, fmt.Errorf("slip_rejected")
+	}
+
+	// Every bet fits, so all of them go through.
+	s.openWallet(w)
+	bets := make([]*Bet, 0, len(slip))
+	for _, sb := range slip {
+		w.reserve(defaultCurrency, sb.Stake)
+		copy := *s.addBet(userID, s.games[sb.GameID], sb.Selection, sb.Stake, defaultCurrency)
+		bets = append(bets, &copy)
+	}
+	s.version++
+	for id := range games {
+		s.publish(s.games[id])
+	}
+	return bets, s.walletView(w), nil, nil
+}
+
+// placeBetAs is placeBet for an operator placing a bet on behalf of userID,
+// such as a kiosk taking bets from walk-up customers. It fails with
+// forbidden unless operatorKey is one of the store's operator keys.
+func (s *store) placeBetAs(ctx context.Context, operatorKey string, userID, gameID int64, sel Selection, stake Tokens, minOdds float64, currency, idemKey string) (*Bet, *Wallet, *Game, error) {
+	if !s.operatorKeys[operatorKey] {
+		return nil, nil, nil, fmt.Errorf("forbidden")
+	}
+	return s.placeBet(ctx, userID, gameID, sel, stake, minOdds, currency, idemKey)
+}
+
+// settle enters the result of a game and pays out its bets. totalPoints is
+// required on games offering an over/under market and ignored otherwise.
+// score, if not nil, is recorded on the game for display.
+func (s *store) settle(ctx context.Context, adminKey string, gameID int64, result Selection, totalPoints *float64, score *Score) (_ *Game, _ Tokens, err error) {
+	ctx, sp := s.tracer.Start(ctx, "store.settle")
+	sp.SetAttr("game_id", gameID)
+	sp.SetAttr("outcome", string(result))
+	defer func() { endSpan(sp, err) }()
+
+	if err := s.lockCtx(ctx); err != nil {
+		return nil, 0, err
+	}
+	defer s.mu.Unlock()
+
+	if !s.hasRole(adminKey, roleSettle) {
+		return nil, 0, fmt.Errorf("forbidden")
+	}
+	return s.settleLocked(ctx, gameID, result, totalPoints, score)
+}
+
+// settleLocked is settle without the admin check. A game with fewer than
+// s.minBets bets is voided and its bets refunded instead, since there was
+// too little action to settle it fairly; the game returned then has
+// StatusVoid. So does a game with no draw market whose score is a tie:
+// nobody backed the result, so it is a push and every bet is refunded.
+// Callers must hold s.mu.
+func (s *store) settleLocked(ctx context.Context, gameID int64, result Selection, totalPoints *float64, score *Score) (*Game, Tokens, error) {
+	plan, err := s.planSettle(ctx, gameID, result, totalPoints, score)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Last chance to give up: past here the settlement is applied in full.
+	if ctx.Err() != nil {
+		return nil, 0, fmt.Errorf("timeout")
+	}
+	g, bets, payouts, capped := plan.game, plan.bets, plan.payouts, plan.capped
+	if plan.void {
+		if plan.pushed {
+			g.Score = score
+		}
+		s.voidLocked(g)
+		return s.gameView(g), 0, nil
+	}
+
+	g.Status = StatusDone
+	g.Result = &result
+	g.Score = score
+	g.SettledAt = time.Now().Format(time.RFC3339)
+	g.CappedTokens = capped
+	if g.TotalsLine != 0 {
+		g.TotalPoints = totalPoints
+	}
+	s.version++
+	defer s.endStream(g)
+
+	for i, b := range bets {
+		b.Payout, b.ReturnedStake = payouts[i].Payout, payouts[i].ReturnedStake
+		b.Won = g.won(b.Selection)
+		s.wallets[b.UserID].credit(b.currency(), b.returned())
+		// the stake leaves the open pool and the payout lands in a
+		// wallet; seeded pool liquidity means these need not match
+		s.totalTokens += b.returned() - b.Stake
+		s.metrics.payouts.Add(int64(b.returned()))
+	}
+	s.metrics.gamesSettled.Add(1)
+	s.hooks.send(webhookEvent{
+		Event:     "game.settled",
+		GameID:    g.ID,
+		Result:    g.Result,
+		HouseTake: plan.houseTake,
+		Payouts:   s.labelPayouts(payouts),
+	})
+	view := s.gameView(g)
+	s.evictGames()
+	return view, plan.houseTake, nil
+}
+
+// settlePlan is how settleLocked would settle a game, worked out by
+// planSettle before anything changes.
+type settlePlan struct {
+	game *Game
+	bets []*Bet // in ID order
+
+	// payouts line up with bets. When void they are refunds of the
+	// stakes and the house takes nothing.
+	payouts   []payout
+	houseTake Tokens
+	capped    Tokens
+
+	// void is set when the game would be voided rather than settled:
+	// for too few bets, or, with pushed, for a tie scored on a game
+	// with no draw market.
+	void, pushed bool
+}
+
+// planSettle works out, without changing anything, how settleLocked would
+// settle gameID as result. Callers must hold s.mu, if only for reading.
+func (s *store) planSettle(ctx context.Context, gameID int64, result Selection, totalPoints *float64, score *Score) (settlePlan, error) {
+	if g, ok := s.games[gameID]; ok && score != nil && result == SelDraw && !g.closed() && !s.drawAllowed(g) {
+		bets, err := s.betsOn(ctx, gameID)
+		if err != nil {
+			return settlePlan{}, err
+		}
+		return settlePlan{game: g, bets: bets, payouts: refunds(bets), void: true, pushed: true}, nil
+	}
+	g, bets, err := s.settleable(ctx, gameID, result, totalPoints)
+	if err != nil {
+		return settlePlan{}, err
+	}
+	if len(bets) < s.minBets {
+		return settlePlan{game: g, bets: bets, payouts: refunds(bets), void: true}, nil
+	}
+	payouts, dust, capped := computePayouts(g, bets, result, totalPoints, s.houseCut, s.rounding)
+	return settlePlan{
+		game:      g,
+		bets:      bets,
+		payouts:   payouts,
+		houseTake: houseTakeFor(settledAs(g, result, totalPoints), s.houseCut) + dust + capped,
+		capped:    capped,
+	}, nil
+}
+
+// refunds pays every bet its stake back.
+func refunds(bets []*Bet) []payout {
+	out := make([]payout, 0, len(bets))
+	for _, b := range bets {
+		out = append(out, payout{BetID: b.ID, UserID: b.UserID, Payout: b.Stake})
+	}
+	return out
+}
+
+// previewSettle reports what settle would pay out, and what the house
+// would keep, without changing anything. voided reports that settle would
+// void the game instead, and pushed that it would be as a push; the
+// payouts are then refunds.
+func (s *store) previewSettle(ctx context.Context, adminKey string, gameID int64, result Selection, totalPoints *float64, score *Score) (payouts []payout, houseTake Tokens, voided, pushed bool, err error) {
+	if err := s.rlockCtx(ctx); err != nil {
+		return nil, 0, false, false, err
+	}
+	defer s.mu.RUnlock()
+
+	if !s.hasRole(adminKey, roleSettle) {
+		return nil, 0, false, false, fmt.Errorf("forbidden")
+	}
+	plan, err := s.planSettle(ctx, gameID, result, totalPoints, score)
+	if err != nil {
+		return nil, 0, false, false, err
+	}
+	return s.labelPayouts(plan.payouts), plan.houseTake, plan.void, plan.pushed, nil
+}
+
+// settleable checks that gameID can be settled as result and returns it
+// along with its bets in ID order, giving up with timeout if ctx is done.
+// Callers must hold s.mu.
+func (s *store) settleable(ctx context.Context, gameID int64, result Selection, totalPoints *float64) (*Game, []*Bet, error) {
+	if !isResult(result) {
+		return nil, nil, fmt.Errorf("bad_selection")
+	}
+	g, ok := s.games[gameID]
+	if !ok {
+		return nil, nil, fmt.Errorf("game_not_found")
+	}
+	if g.closed() {
+		return nil, nil, fmt.Errorf("already_settled")
+	}
+	if result == SelDraw && !s.drawAllowed(g) {
+		return nil, nil, fmt.Errorf("draw_not_allowed")
+	}
+	if g.TotalsLine != 0 && totalPoints == nil {
+		return nil, nil, fmt.Errorf("missing_total_points")
+	}
+	bets, err := s.betsOn(ctx, gameID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return g, bets, nil
+}
+
+// betsOn returns the bets on gameID in ID order, giving up with timeout if
+// ctx is done. Callers must hold s.mu.
+func (s *store) betsOn(ctx context.Context, gameID int64) ([]*Bet, error) {
+	var bets []*Bet
+	for _, b := range s.bets {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("timeout")
+		}
+		if b.GameID == gameID {
+			bets = append(bets, b)
+		}
+	}
+	sort.Slice(bets, func(i, j int) bool { return bets[i].ID < bets[j].ID })
+	return bets, nil
+}
+
+// payout is what one bet is owed at settlement.
+type payout struct {
+	BetID  int64  `json:"bet_id"`
+	UserID int64  `json:"user_id"`
+	Payout Tokens `json:"payout_tokens"`
+
+	// ReturnedStake is the winning stake given back on top of Payout
+	// when stakes are reported apart; see cutRule.
+	ReturnedStake Tokens `json:"returned_stake_tokens,omitempty"`
+
+	// Currency labels Payout; it is filled in by labelPayouts.
+	Currency string `json:"currency,omitempty"`
+}
+
+// returned is everything p pays into the bettor's wallet.
+func (p payout) returned() Tokens {
+	return p.Payout + p.ReturnedStake
+}
+
+// labelPayouts sets the currency of each of out to that of its bet, and
+// returns out. Callers must hold s.mu.
+func (s *store) labelPayouts(out []payout) []payout {
+	for i := range out {
+		if c := s.bets[out[i].BetID].currency(); c != defaultCurrency {
+			out[i].Currency = c
+		} else {
+			out[i].Currency = s.tokenSymbol
+		}
+	}
+	return out
+}
+
+// computePayouts works out what each of bets, all on g and in ID order, is
+// owed if g settles as result. Neither g nor the bets are modified.
+//
+// Each winner's share is rounded per rounding, so the shares of a market
+// need not add up to what its winners are owed together. Rounding never
+// pays out more than that: any excess is taken off the market's largest
+// winner (the lowest bet ID among equals). Any shortfall, the dust, is kept
+// by the house and returned so it can be reported as part of the house take.
+//
+// A fixed-odds game has no pot to share: see fixedPayouts, whose house
+// take is returned as dust.
+//
+// Then, if g has a MaxOdds, no winner is paid more than MaxOdds times its
+// stake. What that holds back is kept by the house too, and returned as
+// capped.
+//
+// Last, unless houseCut.stakeInReturn is set, each winner's stake is moved
+// out of its Payout into ReturnedStake; see cutRule.split.
+func computePayouts(g *Game, bets []*Bet, result Selection, totalPoints *float64, houseCut cutRule, rounding roundingMode) (out []payout, dust, capped Tokens) {
+	settled := settledAs(g, result, totalPoints)
+	if g.FixedOdds {
+		out, dust = fixedPayouts(settled, bets)
+		capped = capPayouts(g, bets, out)
+		houseCut.split(settled, bets, out)
+		return out, dust, capped
+	}
+	out = make([]payout, 0, len(bets))
+	// Keyed by Selection.isTotals, i.e. by market.
+	paid, staked := map[bool]Tokens{}, map[bool]Tokens{}
+	largest := map[bool]int{}
+	for i, b := range bets {
+		p := payoutFor(settled, b, houseCut, rounding)
+		out = append(out, payout{BetID: b.ID, UserID: b.UserID, Payout: p})
+		if !settled.won(b.Selection) {
+			continue
+		}
+		m := b.Selection.isTotals()
+		paid[m] += p
+		staked[m] += b.Stake
+		if j, ok := largest[m]; !ok || p > out[j].Payout {
+			largest[m] = i
+		}
+	}
+
+	for m, sum := range paid {
+		result, total := settled.marketFor(bets[largest[m]].Selection)
+		winnerPool := settled.poolFor(*result)
+		pot := total - houseCut.of(total)
+		owed := mulDivRound(staked[m], pot, winnerPool, roundFloor)
+		if sum > owed {
+			out[largest[m]].Payout -= sum - owed
+		} else {
+			dust += owed - sum
+		}
+	}
+
+	capped = capPayouts(g, bets, out)
+	houseCut.split(settled, bets, out)
+	return out, dust, capped
+}
+
+// fixedPayouts pays each winning bet on a settled fixed-odds game its
+// stake times its locked odds, to the nearest millitoken so float error
+// in the product can't leave it a millitoken short, and each losing bet
+// nothing.
+// The house keeps the stakes and pays the winners, so houseTake is every
+// stake less every payout, negative when the house lost on the game.
+func fixedPayouts(g *Game, bets []*Bet) (out []payout, houseTake Tokens) {
+	out = make([]payout, 0, len(bets))
+	for _, b := range bets {
+		var p Tokens
+		if g.won(b.Selection) {
+			p = Tokens(math.Round(float64(b.Stake) * b.LockedOdds))
+		}
+		out = append(out, payout{BetID: b.ID, UserID: b.UserID, Payout: p})
+		houseTake += b.Stake - p
+	}
+	return out, houseTake
+}
+
+// capPayouts holds each of out, the payouts of bets on g, to g.MaxOdds
+// times the bet's stake and returns how much that held back in all.
+func capPayouts(g *Game, bets []*Bet, out []payout) Tokens {
+	if g.MaxOdds <= 0 {
+		return 0
+	}
+	var capped Tokens
+	for i, b := range bets {
+		if limit := Tokens(float64(b.Stake) * g.MaxOdds); out[i].Payout > limit {
+			capped += out[i].Payout - limit
+			out[i].Payout = limit
+		}
+	}
+	return capped
+}
+
+// roundingMode says how a winner's fractional share of a pot becomes whole
+// millitokens.
+type roundingMode string
+
+const (
+	roundFloor roundingMode = "floor"
+	roundHalf  roundingMode = "round" // half up
+	roundCeil  roundingMode = "ceil"
+)
+
+func (m roundingMode) valid() bool {
+	return m == roundFloor || m == roundHalf || m == roundCeil
+}
+
+// mulDivRound returns a * b / d rounded per mode, for a, b >= 0, d > 0 and
+// a <= d. The product is taken in 128 bits so large pools can't overflow.
+func mulDivRound(a, b, d Tokens, mode roundingMode) Tokens {
+	hi, lo := bits.Mul64(uint64(a), uint64(b))
+	q, r := bits.Div64(hi, lo, uint64(d))
+	if (mode == roundCeil && r > 0) || (mode == roundHalf && r >= uint64(d)-r) {
+		q++
+	}
+	return Tokens(q)
+}
+
+// settledAs returns a copy of g as it would look settled as result.
+func settledAs(g *Game, result Selection, totalPoints *float64) *Game {
+	settled := *g
+	settled.Status, settled.Result = StatusDone, &result
+	if g.TotalsLine != 0 {
+		settled.TotalPoints = totalPoints
+	}
+	return &settled
+}
+
+// batchSummary reports what ingestResults did with each game.
+type batchSummary struct {
+	Settled []int64          `json:"settled"`
+	Voided  []int64          `json:"voided"` // too few bets; see settleLocked
+	Skipped []int64          `json:"skipped"`
+	Failed  map[int64]string `json:"failed"`
+}
+
+// ingestResults settles many games at once, e.g. a day's results from a
+// feed. Games already settled are skipped and per-game errors are collected
+// rather than aborting the batch. Every ID is checked before anything is
+// settled: if any game doesn't exist the whole batch is rejected and the
+// unknown IDs are reported as failed.
+func (s *store) ingestResults(ctx context.Context, results map[int64]Selection, adminKey string) (batchSummary, error) {
+	sum := batchSummary{Settled: []int64{}, Voided: []int64{}, Skipped: []int64{}, Failed: map[int64]string{}}
+	if err := s.lockCtx(ctx); err != nil {
+		return sum, err
+	}
+	defer s.mu.Unlock()
+
+	if !s.hasRole(adminKey, roleSettle) {
+		return sum, fmt.Errorf("forbidden")
+	}
+	ids := make([]int64, 0, len(results))
+	for id := range results {
+		if _, ok := s.games[id]; !ok {
+			sum.Failed[id] = "game_not_found"
+		}
+		ids = append(ids, id)
+	}
+	if len(sum.Failed) > 0 {
+		return sum, fmt.Errorf("game_not_found")
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		if s.games[id].closed() {
+			sum.Skipped = append(sum.Skipped, id)
+			continue
+		}
+		g, _, err := s.settleLocked(ctx, id, results[id], nil, nil)
+		if err != nil {
+			sum.Failed[id] = err.Error()
+			continue
+		}
+		if g.Status == StatusVoid {
+			sum.Voided = append(sum.Voided, id)
+			continue
+		}
+		sum.Settled = append(sum.Settled, id)
+	}
+	return sum, nil
+}
+
+// resettle corrects the result of a settled game. Every bet's recorded
+// payout is clawed back and the corrected payout is credited instead, so
+// balances end up exactly as if newResult had been entered first. If that
+// would leave any wallet negative (winnings already spent) nothing changes
+// and cannot_resettle is returned. A nil totalPoints keeps the score
+// already entered.
+func (s *store) resettle(ctx context.Context, adminKey string, gameID int64, newResult Selection, totalPoints *float64, score *Score) (*Game, Tokens, error) {
+	if err := s.lockCtx(ctx); err != nil {
+		return nil, 0, err
+	}
+	defer s.mu.Unlock()
+
+	if !s.hasRole(adminKey, roleSettle) {
+		return nil, 0, fmt.Errorf("forbidden")
+	}
+	g, ok := s.games[gameID]
+	if !ok {
+		return nil, 0, fmt.Errorf("game_not_found")
+	}
+	if g.Status != StatusDone {
+		return nil, 0, fmt.Errorf("not_settled")
+	}
+	if !isResult(newResult) {
+		return nil, 0, fmt.Errorf("bad_selection")
+	}
+	if newResult == SelDraw && !s.drawAllowed(g) {
+		return nil, 0, fmt.Errorf("draw_not_allowed")
+	}
+
+	prev, prevPoints := g.Result, g.TotalPoints
+	g.Result = &newResult
+	if g.TotalsLine != 0 && totalPoints != nil {
+		g.TotalPoints = totalPoints
+	}
+
+	type change struct {
+		bet    *Bet
+		payout payout
+	}
+	var changes []change
+	type walletCurrency struct {
+		userID   int64
+		currency string
+	}
+	net := map[walletCurrency]Tokens{}
+	bets, err := s.betsOn(ctx, gameID)
+	if err != nil {
+		g.Result, g.TotalPoints = prev, prevPoints
+		return nil, 0, err
+	}
+	payouts, dust, capped := computePayouts(g, bets, newResult, g.TotalPoints, s.houseCut, s.rounding)
+	for i, b := range bets {
+		changes = append(changes, change{b, payouts[i]})
+		net[walletCurrency{b.UserID, b.currency()}] += payouts[i].returned() - b.returned()
+	}
+	for wc, delta := range net {
+		if s.wallets[wc.userID].balance(wc.currency)+delta < 0 {
+			g.Result, g.TotalPoints = prev, prevPoints
+			return nil, 0, fmt.Errorf("cannot_resettle")
+		}
+	}
+
+	for _, c := range changes {
+		s.wallets[c.bet.UserID].credit(c.bet.currency(), c.payout.returned()-c.bet.returned())
+		s.totalTokens += c.payout.returned() - c.bet.returned()
+		c.bet.Payout, c.bet.ReturnedStake = c.payout.Payout, c.payout.ReturnedStake
+		c.bet.Won = g.won(c.bet.Selection)
+	}
+	g.Score = score
+	g.CappedTokens = capped
+	s.version++
+	return s.gameView(g), houseTakeFor(g, s.houseCut) + dust + capped, nil
+}
+
+// houseTakeFor is what the house kept when g settled: houseCut of each
+// market, or nothing from a market where no one backed the result.
+// Fixed-odds games take no cut; see fixedPayouts.
+func houseTakeFor(g *Game, houseCut cutRule) Tokens {
+	if g.FixedOdds {
+		return 0
+	}
+	var take Tokens
+	for _, sel := range []Selection{SelHome, SelOver} {
+		result, total := g.marketFor(sel)
+		if result != nil && g.poolFor(*result) > 0 {
+			take += houseCut.of(total)
+		}
+	}
+	return take
+}
+
+// cutRule is how much of each settled market the house keeps, and how
+// what a winner gets back is reported.
+type cutRule struct {
+	rate float64
+
+	// stakeInReturn says whether a winner's payout includes its own stake.
+	// Say a market has total tokens staked, winnerPool of them on the
+	// result, and the house keeps cut = rate * total. A winner staking x
+	// gets back
+	//
+	//	r = x * (total - cut) / winnerPool
+	//
+	// When stakeInReturn is set (the default) all of r is its payout.
+	// Otherwise the payout is the winnings alone, r - x, and x is its
+	// returned stake; should the cut leave r below x, the returned stake
+	// is r and the payout 0. The wallet is credited r either way, so the
+	// winner's net gain, r - x, is the same in both modes.
+	stakeInReturn bool
+}
+
+// of returns the cut, rounded down, from a market of total tokens.
+func (c cutRule) of(total Tokens) Tokens {
+	return Tokens(float64(total) * c.rate)
+}
+
+// split moves the stake of each winner among bets out of its payout in
+// out and into ReturnedStake, unless c.stakeInReturn is set. g is the
+// game as settled. Refunds are left alone: they are stakes already.
+func (c cutRule) split(g *Game, bets []*Bet, out []payout) {
+	if c.stakeInReturn {
+		return
+	}
+	for i, b := range bets {
+		if g.won(b.Selection) {
+			out[i].ReturnedStake = min(b.Stake, out[i].Payout)
+			out[i].Payout -= out[i].ReturnedStake
+		}
+	}
+}
+
+// payoutFor returns what b is owed once g has settled: its share of its
+// market's pot if it won, its stake back if the game was voided or the
+// totals market pushed, and nothing otherwise. Each market is its own pool:
+// the house keeps its cut (see cutRule.of) and winners split the rest in
+// proportion to their stakes, so what a winner is paid includes its stake;
+// computePayouts may then report that apart, per cutRule.split.
+// The split is done in integer math and rounded per rounding, so it is
+// deterministic; computePayouts reconciles the rounded shares with the pot.
+func payoutFor(g *Game, b *Bet, houseCut cutRule, rounding roundingMode) Tokens {
+	if !g.closed() {
+		return 0
+	}
+	result, total := g.marketFor(b.Selection)
+	if result == nil {
+		return b.Stake
+	}
+	winnerPool := g.poolFor(*result)
+	if b.Selection != *result || winnerPool == 0 {
+		return 0
+	}
+	pot := total - houseCut.of(total)
+	return mulDivRound(b.Stake, pot, winnerPool, rounding)
+}
+
+// quotePayout is what a new bet of stake on sel would be paid if sel won,
+// by the same math as settlement: g, with bets (in ID order) already on it,
+// is settled as a copy with the new bet added last. Neither g nor bets are
+// modified.
+func quotePayout(g *Game, bets []*Bet, sel Selection, stake Tokens, houseCut cutRule, rounding roundingMode) payout {
+	trial := *g
+	trial.addStake(sel, stake)
+	b := &Bet{GameID: g.ID, Selection: sel, Stake: stake}
+	if g.FixedOdds {
+		b.LockedOdds = g.fixedOddsFor(sel)
+	}
+	result, totalPoints := sel, (*float64)(nil)
+	if sel.isTotals() {
+		// The match result doesn't touch the totals market; any will do.
+		result = SelHome
+		total := g.TotalsLine + 1
+		if sel == SelUnder {
+			total = g.TotalsLine - 1
+		}
+		totalPoints = &total
+	}
+	out, _, _ := computePayouts(&trial, append(slices.Clip(bets), b), result, totalPoints, houseCut, rounding)
+	return out[len(out)-1]
+}
+
+// betQuote is the answer to GET games/{id}/quote.
+type betQuote struct {
+	Selection Selection `json:"selection"`
+	Stake     Tokens    `json:"stake_tokens"`
+	Payout    Tokens    `json:"payout_tokens"`
+	Odds      float64   `json:"odds"` // everything paid back over Stake
+
+	// ReturnedStake is set when stakes are reported apart from payouts;
+	// see cutRule.
+	ReturnedStake Tokens `json:"returned_stake_tokens,omitempty"`
+
+	// Game is the game as it would be with the bet placed.
+	Game *Game `json:"game"`
+}
+
+// quote works out what a bet of stake on sel would pay if it won, were it
+// placed now, without placing it. It fails as placing the bet would, bar
+// the wallet and per-user checks.
+func (s *store) quote(gameID int64, sel Selection, stake Tokens) (*betQuote, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	g := s.games[gameID]
+	if err := s.checkBet(0, g, sel, stake, 0); err != nil {
+		return nil, err
+	}
+	bets, err := s.betsOn(context.Background(), gameID)
+	if err != nil {
+		return nil, err
+	}
+	p := quotePayout(g, bets, sel, stake, s.houseCut, s.rounding)
+	trial := s.gameView(g)
+	trial.addStake(sel, stake)
+	addOdds(trial, s.odds)
+	trial.BetCount++
+	return &betQuote{
+		Selection:     sel,
+		Stake:         stake,
+		Payout:        p.Payout,
+		ReturnedStake: p.ReturnedStake,
+		Odds:          roundHalfUp(float64(p.returned())/float64(stake), s.odds.decimals),
+		Game:          trial,
+	}, nil
+}
+
+// oddsMove is how one selection's odds would change; see impact.
+type oddsMove struct {
+	Selection Selection `json:"selection"`
+	Before    float64   `json:"before"`
+	After     float64   `json:"after"`
+
+	// MovePct is the change as a percentage of Before, or 0 if there was
+	// no price before.
+	MovePct float64 `json:"move_pct"`
+}
+
+// impact works out how staking stake on sel would move the odds of each
+// selection in its market, priced per oc, without placing anything. Unlike
+// quote it skips the stake and pool limits, since traders use it to size
+// bets larger than a user could place.
+func (s *store) impact(gameID int64, sel Selection, stake Tokens, oc oddsConfig) ([]oddsMove, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	g, ok := s.games[gameID]
+	switch {
+	case !ok:
+		return nil, fmt.Errorf("game_not_found")
+	case g.closed():
+		return nil, fmt.Errorf("game_settled")
+	case !isValidSelection(sel):
+		return nil, fmt.Errorf("bad_selection")
+	case stake <= 0:
+		return nil, fmt.Errorf("bad_stake")
+	case sel == SelDraw && !s.drawAllowed(g):
+		return nil, fmt.Errorf("draw_not_allowed")
+	case sel.isTotals() && g.TotalsLine == 0:
+		return nil, fmt.Errorf("totals_not_offered")
+	}
+
+	before, after := *g, *g
+	after.addStake(sel, stake)
+	addOdds(&before, oc)
+	addOdds(&after, oc)
+
+	market := []Selection{SelHome, SelAway}
+	if s.drawAllowed(g) {
+		market = append(market, SelDraw)
+	}
+	if sel.isTotals() {
+		market = []Selection{SelOver, SelUnder}
+	}
+	moves := make([]oddsMove, 0, len(market))
+	for _, m := range market {
+		mv := oddsMove{Selection: m, Before: before.oddsFor(m), After: after.oddsFor(m)}
+		if mv.Before > 0 {
+			mv.MovePct = math.Round((mv.After-mv.Before)/mv.Before*10000) / 100
+		}
+		moves = append(moves, mv)
+	}
+	return moves, nil
+}
+
+// openBetCount counts userID's bets on games that haven't settled.
+// Callers must hold s.mu.
+func (s *store) openBetCount(userID int64) int {
+	n := 0
+	for _, b := range s.bets {
+		if b.UserID == userID && !s.games[b.GameID].closed() {
+			n++
+		}
+	}
+	return n
+}
+
+// cashOut returns fraction of an open bet's stake to the bettor's wallet and
+// takes it back out of the pool. In a pari-mutuel pool the implied value of
+// a bet is stake * odds * probability, which is exactly its stake, so the
+// cash-out amount is simply fraction * stake. Cashing out the whole stake
+// removes the bet; in that case the returned bet is nil.
+func (s *store) cashOut(userID, betID int64, fraction float64) (*Bet, *Wallet, Tokens, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !(fraction > 0 && fraction <= 1) {
+		return nil, nil, 0, fmt.Errorf("bad_fraction")
+	}
+	b, ok := s.bets[betID]
+	if !ok {
+		return nil, nil, 0, fmt.Errorf("bet_not_found")
+	}
+	if b.UserID != userID {
+		return nil, nil, 0, fmt.Errorf("forbidden")
+	}
+	g := s.games[b.GameID]
+	if g.closed() {
+		return nil, nil, 0, fmt.Errorf("game_settled")
+	}
+	if hasStarted(g, time.Now()) {
+		return nil, nil, 0, fmt.Errorf("game_started")
+	}
+
+	amount := Tokens(math.Round(float64(b.Stake) * fraction))
+	if amount <= 0 {
+		return nil, nil, 0, fmt.Errorf("bad_fraction")
+	}
+	switch b.Selection {
+	case SelHome:
+		g.HomePool -= amount
+	case SelAway:
+		g.AwayPool -= amount
+	case SelDraw:
+		g.DrawPool -= amount
+	case SelOver:
+		g.OverPool -= amount
+	case SelUnder:
+		g.UnderPool -= amount
+	}
+	w := s.wallets[userID]
+	w.credit(b.currency(), amount)
+	b.Stake -= amount
+	s.version++
+	s.publish(g)
+
+	if b.Stake == 0 {
+		delete(s.bets, b.ID)
+		return nil, s.walletView(w), amount, nil
+	}
+	bc := *b
+	return &bc, s.walletView(w), amount, nil
+}
+
+// cancelBet undoes a bet placed by mistake: the whole stake goes back to the
+// wallet and out of the pool, and the bet is deleted. It is only allowed
+// while the game is still open for betting.
+func (s *store) cancelBet(userID, betID int64) (*Wallet, error) {
+	_, w, _, err := s.cashOut(userID, betID, 1)
+	return w, err
+}
+
+// setFeaturedRank features gameID at rank on the games list, where lower
+// ranks come first, or unfeatures it if rank is 0.
+func (s *store) setFeaturedRank(adminKey string, gameID int64, rank int) (*Game, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.hasRole(adminKey, roleCreate) {
+		return nil, fmt.Errorf("forbidden")
+	}
+	if rank < 0 {
+		return nil, fmt.Errorf("bad_rank")
+	}
+	g, ok := s.games[gameID]
+	if !ok {
+		return nil, fmt.Errorf("game_not_found")
+	}
+	if g.FeaturedRank != rank {
+		g.FeaturedRank = rank
+		s.version++
+	}
+	return s.gameView(g), nil
+}
+
+// setBettingOpen suspends (open false) or resumes betting on an unsettled
+// game. Suspending a suspended game, or resuming an open one, is a no-op.
+func (s *store) setBettingOpen(ctx context.Context, adminKey string, gameID int64, open bool) (*Game, error) {
+	if err := s.lockCtx(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	if !s.hasRole(adminKey, roleSettle) {
+		return nil, fmt.Errorf("forbidden")
+	}
+	g, ok := s.games[gameID]
+	if !ok {
+		return nil, fmt.Errorf("game_not_found")
+	}
+	if g.closed() {
+		return nil, fmt.Errorf("game_settled")
+	}
+	if g.BettingOpen != open {
+		g.BettingOpen = open
+		s.version++
+		s.publish(g)
+	}
+	return s.gameView(g), nil
+}
+
+// voidGame cancels a game without a result: it moves to StatusVoid and every
+// bet on it is refunded in full. Stream subscribers get the voided game as
+// their final update.
+func (s *store) voidGame(ctx context.Context, adminKey string, gameID int64) (*Game, []int64, Tokens, error) {
+	if err := s.lockCtx(ctx); err != nil {
+		return nil, nil, 0, err
+	}
+	defer s.mu.Unlock()
+
+	if !s.hasRole(adminKey, roleSettle) {
+		return nil, nil, 0, fmt.Errorf("forbidden")
+	}
+	g, ok := s.games[gameID]
+	if !ok {
+		return nil, nil, 0, fmt.Errorf("game_not_found")
+	}
+	if g.closed() {
+		return nil, nil, 0, fmt.Errorf("already_settled")
+	}
+	users, refunded := s.voidLocked(g)
+	return s.gameView(g), users, refunded, nil
+}
+
+// voidLocked voids g, which must still be open, refunding its bets. It
+// returns who was refunded and how much in all. Callers must hold s.mu.
+func (s *store) voidLocked(g *Game) ([]int64, Tokens) {
+	g.Status = StatusVoid
+	g.Result = nil
+	g.CancelledAt = time.Now().Format(time.RFC3339)
+	s.version++
+	defer s.endStream(g)
+
+	var refunded Tokens
+	users := []int64{}
+	seen := map[int64]bool{}
+	refunds := []payout{}
+	for _, b := range s.bets {
+		if b.GameID != g.ID {
+			continue
+		}
+		b.Payout, b.ReturnedStake, b.Won = b.Stake, 0, false
+		s.wallets[b.UserID].credit(b.currency(), b.Stake)
+		refunded += b.Stake
+		refunds = append(refunds, payout{BetID: b.ID, UserID: b.UserID, Payout: b.Stake})
+		if !seen[b.UserID] {
+			seen[b.UserID] = true
+			users = append(users, b.UserID)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i] < users[j] })
+	sort.Slice(refunds, func(i, j int) bool { return refunds[i].BetID < refunds[j].BetID })
+	s.hooks.send(webhookEvent{Event: "game.voided", GameID: g.ID, Payouts: s.labelPayouts(refunds)})
+	s.evictGames()
+	return users, refunded
+}
+
+// reopenError is returned by reopenGame when some refunded users no longer
+// have their refund to give back.
+type reopenError struct {
+	users []int64
+}
+
+func (e *reopenError) Error() string { return "cannot_reopen" }
+
+// reopenGame undoes voidGame for a game voided by mistake: every refund is
+// taken back out of its wallet, which leaves the stakes in the pools again,
+// and the game returns to StatusPre. If any user has since spent their
+// refund, nothing changes and the error is a *reopenError naming them.
+func (s *store) reopenGame(adminKey string, gameID int64) (*Game, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.hasRole(adminKey, roleSettle) {
+		return nil, fmt.Errorf("forbidden")
+	}
+	g, ok := s.games[gameID]
+	if !ok {
+		return nil, fmt.Errorf("game_not_found")
+	}
+	if g.Status != StatusVoid {
+		return nil, fmt.Errorf("not_voided")
+	}
+
+	type owed struct {
+		userID   int64
+		currency string
+	}
+	refunds := map[owed]Tokens{}
+	for _, b := range s.bets {
+		if b.GameID == g.ID {
+			refunds[owed{b.UserID, b.currency()}] += b.Stake
+		}
+	}
+	short := []int64{}
+	seen := map[int64]bool{}
+	for o, amount := range refunds {
+		if s.wallets[o.userID].balance(o.currency) < amount && !seen[o.userID] {
+			seen[o.userID] = true
+			short = append(short, o.userID)
+		}
+	}
+	if len(short) > 0 {
+		sort.Slice(short, func(i, j int) bool { return short[i] < short[j] })
+		return nil, &reopenError{short}
+	}
+
+	for o, amount := range refunds {
+		s.wallets[o.userID].credit(o.currency, -amount)
+	}
+	for _, b := range s.bets {
+		if b.GameID == g.ID {
+			b.Payout = 0
+		}
+	}
+	g.Status = StatusPre
+	g.Score = nil
+	g.CancelledAt = ""
+	g.ReopenedAt = time.Now().Format(time.RFC3339)
+	s.version++
+	s.publish(g)
+	return s.gameView(g), nil
+}
+
+// sweepStale voids every game still awaiting a result more than
+// s.staleAfter after its start time, or after it was reopened if that was
+// later, as of now, refunding its bets so they aren't locked up by a game
+// nobody settles. It returns the voided games' IDs in order. It does
+// nothing when s.staleAfter is zero.
+func (s *store) sweepStale(now time.Time) []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	voided := []int64{}
+	if s.staleAfter <= 0 {
+		return voided
+	}
+	for _, g := range s.games {
+		if g.Status != StatusPre {
+			continue
+		}
+		start, err := parseStartTime(g.StartTime)
+		if err != nil {
+			continue
+		}
+		if reopened, err := time.Parse(time.RFC3339, g.ReopenedAt); err == nil && reopened.After(start) {
+			start = reopened
+		}
+		if now.Sub(start) <= s.staleAfter {
+			continue
+		}
+		s.voidLocked(g)
+		voided = append(voided, g.ID)
+	}
+	sort.Slice(voided, func(i, j int) bool { return voided[i] < voided[j] })
+	return voided
+}
+
+// sweepEvery runs sweepStale on every tick.
+func (s *store) sweepEvery(every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for now := range t.C {
+		if ids := s.sweepStale(now); len(ids) > 0 {
+			log.Printf("sweeper: voided stale games %v", ids)
+		}
+	}
+}
+
+// auditReport is the token accounting checked by auditInvariant.
+type auditReport struct {
+	WalletTokens    Tokens `json:"wallet_tokens"`
+	OpenStakeTokens Tokens `json:"open_stake_tokens"`
+	ExpectedTokens  Tokens `json:"expected_tokens"`
+	OK              bool   `json:"ok"`
+}
+
+// auditInvariant checks that wallet balances plus stakes on unsettled games
+// add up to totalTokens, i.e. that nothing other than deposits, settlement
+// and admin adjustments has created or destroyed tokens. The report is
+// returned either way so a leak can be diagnosed.
+func (s *store) auditInvariant() (auditReport, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r := s.tally()
+	if !r.OK {
+		return r, fmt.Errorf("token_leak: have %s, expected %s",
+			r.WalletTokens+r.OpenStakeTokens, r.ExpectedTokens)
+	}
+	return r, nil
+}
+
+// payoutMismatch is a bet on a settled game whose recorded payout differs
+// from what its game's result says it is owed.
+type payoutMismatch struct {
+	GameID int64 `json:"game_id"`
+	BetID  int64 `json:"bet_id"`
+	UserID int64 `json:"user_id"`
+
+	// Expected and Paid include any returned stake.
+	Expected Tokens `json:"expected_payout_tokens"`
+	Paid     Tokens `json:"payout_tokens"`
+}
+
+// reconcileReport is the result of reconcile.
+type reconcileReport struct {
+	GamesChecked int              `json:"games_checked"`
+	BetsChecked  int              `json:"bets_checked"`
+	Mismatches   []payoutMismatch `json:"mismatches"`
+	OK           bool             `json:"ok"`
+}
+
+// reconcile recomputes the payouts of every settled game from its result and
+// pools, as settleLocked does, and lists each bet whose recorded Payout
+// disagrees. Voided games are left out: their bets are refunds.
+func (s *store) reconcile() reconcileReport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	byGame := map[int64][]*Bet{}
+	for _, g := range s.games {
+		if g.Status == StatusDone {
+			byGame[g.ID] = nil
+		}
+	}
+	for _, b := range s.bets {
+		if bets, ok := byGame[b.GameID]; ok {
+			byGame[b.GameID] = append(bets, b)
+		}
+	}
+
+	r := reconcileReport{Mismatches: []payoutMismatch{}}
+	for id, bets := range byGame {
+		g := s.games[id]
+		sort.Slice(bets, func(i, j int) bool { return bets[i].ID < bets[j].ID })
+		want, _, _ := computePayouts(g, bets, *g.Result, g.TotalPoints, s.houseCut, s.rounding)
+		for i, b := range bets {
+			if b.returned() != want[i].returned() {
+				r.Mismatches = append(r.Mismatches, payoutMismatch{g.ID, b.ID, b.UserID, want[i].returned(), b.returned()})
+			}
+		}
+		r.GamesChecked++
+		r.BetsChecked += len(bets)
+	}
+	sort.Slice(r.Mismatches, func(i, j int) bool { return r.Mismatches[i].BetID < r.Mismatches[j].BetID })
+	r.OK = len(r.Mismatches) == 0
+	return r
+}
+
+// tally sums balances and open stakes. Callers must hold s.mu.
+func (s *store) tally() auditReport {
+	r := auditReport{ExpectedTokens: s.totalTokens}
+	for _, w := range s.wallets {
+		r.WalletTokens += w.Balance
+		for _, v := range w.Balances {
+			r.WalletTokens += v
+		}
+	}
+	for _, b := range s.bets {
+		if !s.games[b.GameID].closed() {
+			r.OpenStakeTokens += b.Stake
+		}
+	}
+	r.OK = r.WalletTokens+r.OpenStakeTokens == r.ExpectedTokens
+	return r
+}
+
+// storeStats is the body of GET healthz.
+type storeStats struct {
+	Games        int    `json:"games"`
+	MaxGames     int    `json:"max_games,omitempty"`
+	OpenBets     int    `json:"open_bets"`
+	SettledGames int    `json:"settled_games"`
+	TotalTokens  Tokens `json:"total_tokens"`
+}
+
+// stats counts games and open bets for the health check.
+func (s *store) stats() storeStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := storeStats{Games: len(s.games), MaxGames: s.maxGames, TotalTokens: s.totalTokens}
+	for _, g := range s.games {
+		if g.Status == StatusDone {
+			out.SettledGames++
+		}
+	}
+	for _, b := range s.bets {
+		if !s.games[b.GameID].closed() {
+			out.OpenBets++
+		}
+	}
+	return out
+}
+
+// hasStarted reports whether betting on g should be closed at now. A start
+// time we can't read is treated as already started.
+func hasStarted(g *Game, now time.Time) bool {
+	start, err := parseStartTime(g.StartTime)
+	return err != nil || !now.Before(start)
+}
+
+// statusFor is g's status as clients see it at now. The store only records
+// StatusPre until a game is settled or voided; once its start time has
+// passed such a game is reported as StatusLive, which takes no bets but can
+// still be settled.
+func statusFor(g *Game, now time.Time) GameStatus {
+	if g.Status == StatusPre && hasStarted(g, now) {
+		return StatusLive
+	}
+	return g.Status
+}
+
+// startTimeLayouts are the formats parseStartTime accepts besides RFC 3339
+// and Unix seconds. Times without a zone are taken as UTC.
+var startTimeLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04", // what an HTML datetime-local input sends
+}
+
+// parseStartTime reads a game start time given as RFC 3339, Unix seconds,
+// or one of startTimeLayouts, failing with bad_start_time_format otherwise.
+func parseStartTime(v string) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	for _, layout := range startTimeLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad_start_time_format")
+}
+
+// stringOrNumber is a JSON string that may also be sent as a bare number,
+// such as a Unix timestamp for start_time.
+type stringOrNumber string
+
+func (v *stringOrNumber) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*v = stringOrNumber(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	*v = stringOrNumber(n)
+	return nil
+}
+
+// snapshotData is the on-disk shape of the store.
+type snapshotData struct {
+	Games    []*Game   `json:"games"`
+	Bets     []*Bet    `json:"bets"`
+	Wallets  []*Wallet `json:"wallets"`
+	NextGame int64     `json:"next_game"`
+
+	IdempotencyKeys map[string]int64 `json:"idempotency_keys,omitempty"`
+	TotalTokens     *Tokens          `json:"total_tokens,omitempty"`
+	AuditLog        []auditEntry     `json:"audit_log,omitempty"`
+}
+
+func (s *store) snapshot(w io.Writer) error {
+	s.mu.RLock()
+	data := snapshotData{
+		Games:    make([]*Game, 0, len(s.games)),
+		Bets:     make([]*Bet, 0, len(s.bets)),
+		Wallets:  make([]*Wallet, 0, len(s.wallets)),
+		NextGame: s.nextGame,
+
+		IdempotencyKeys: make(map[string]int64, len(s.idemKeys)),
+	}
+	for k, id := range s.idemKeys {
+		data.IdempotencyKeys[k] = id
+	}
+	for _, g := range s.games {
+		copy := *g
+		data.Games = append(data.Games, &copy)
+	}
+	for _, b := range s.bets {
+		copy := *b
+		data.Bets = append(data.Bets, &copy)
+	}
+	for _, wlt := range s.wallets {
+		data.Wallets = append(data.Wallets, wlt.clone())
+	}
+	total := s.totalTokens
+	data.TotalTokens = &total
+	data.AuditLog = append([]auditEntry(nil), s.auditLog...)
+	s.mu.RUnlock()
+
+	return json.NewEncoder(w).Encode(&data)
+}
+
+// restore replaces the store's contents with a snapshot. The game ID
+// counter is bumped past anything loaded so new games never collide.
+func (s *store) restore(r io.Reader) error {
+	var data snapshotData
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.games = make(map[int64]*Game, len(data.Games))
+	s.bets = make(map[int64]*Bet, len(data.Bets))
+	s.wallets = make(map[int64]*Wallet, len(data.Wallets))
+	s.idemKeys = make(map[string]int64, len(data.IdempotencyKeys))
+	s.auditLog = data.AuditLog
+	s.nextGame = max(data.NextGame, 1)
+	for _, g := range data.Games {
+		s.games[g.ID] = g
+		s.nextGame = max(s.nextGame, g.ID+1)
+	}
+	for _, b := range data.Bets {
+		s.bets[b.ID] = b
+	}
+	for _, wlt := range data.Wallets {
+		s.wallets[wlt.UserID] = wlt
+	}
+	for k, id := range data.IdempotencyKeys {
+		if _, ok := s.bets[id]; ok {
+			s.idemKeys[k] = id
+		}
+	}
+	if data.TotalTokens != nil {
+		s.totalTokens = *data.TotalTokens
+	} else {
+		// older snapshot: trust what was loaded
+		r := s.tally()
+		s.totalTokens = r.WalletTokens + r.OpenStakeTokens
+	}
+	// a snapshot taken before MAX_GAMES was lowered can hold more
+	s.evictGames()
+	return nil
+}
+
+// flushEvery writes a snapshot to path on every tick. Each write goes to a
+// temp file first so a crash mid-write never leaves a truncated snapshot.
+func (s *store) flushEvery(path string, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for range t.C {
+		if err := s.flushTo(path); err != nil {
+			log.Printf("snapshot: flush %s: %v", path, err)
+		}
+	}
+}
+
+func (s *store) flushTo(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := s.snapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// MarshalJSON adds the list of selectable outcomes and leaves out entirely
+// the draw market for games that can't end in a draw and the over/under
+// market for games without a totals line.
+func (g Game) MarshalJSON() ([]byte, error) {
+	type plain Game
+	type game struct{ plain }
+	sels := []Selection{SelHome, SelAway}
+	if g.AllowDraw {
+		sels = append(sels, SelDraw)
+	}
+	if g.TotalsLine != 0 {
+		sels = append(sels, SelOver, SelUnder)
+	}
+	// Shallower fields win in encoding/json, so embedding hideDraw or
+	// hideTotals next to the game shadows and drops the fields of markets
+	// it doesn't offer.
+	switch {
+	case g.AllowDraw && g.TotalsLine != 0:
+		return json.Marshal(struct {
+			game
+			Selections []Selection `json:"selections"`
+		}{game{plain(g)}, sels})
+	case g.AllowDraw:
+		return json.Marshal(struct {
+			game
+			hideTotals
+			Selections []Selection `json:"selections"`
+		}{game: game{plain(g)}, Selections: sels})
+	case g.TotalsLine != 0:
+		return json.Marshal(struct {
+			game
+			hideDraw
+			Selections []Selection `json:"selections"`
+		}{game: game{plain(g)}, Selections: sels})
+	}
+	return json.Marshal(struct {
+		game
+		hideDraw
+		hideTotals
+		Selections []Selection `json:"selections"`
+	}{game: game{plain(g)}, Selections: sels})
+}
+
+// hideDraw and hideTotals mask a game's draw and over/under fields; see
+// Game.MarshalJSON.
+type hideDraw struct {
+	DrawPool  *struct{} `json:"draw_pool_tokens,omitempty"`
+	DrawOdds  *struct{} `json:"draw_odds,omitempty"`
+	DrawProb  *struct{} `json:"draw_prob,omitempty"`
+	DrawShare *struct{} `json:"draw_pool_share,omitempty"`
+	DrawUS    *struct{} `json:"draw_odds_american,omitempty"`
+	DrawFixed *struct{} `json:"fixed_draw_odds,omitempty"`
+	DrawFair  *struct{} `json:"draw_implied,omitempty"`
+}
+
+type hideTotals struct {
+	TotalsLine  *struct{} `json:"totals_line,omitempty"`
+	TotalPoints *struct{} `json:"total_points,omitempty"`
+	OverPool    *struct{} `json:"over_pool_tokens,omitempty"`
+	UnderPool   *struct{} `json:"under_pool_tokens,omitempty"`
+	OverOdds    *struct{} `json:"over_odds,omitempty"`
+	UnderOdds   *struct{} `json:"under_odds,omitempty"`
+	OverProb    *struct{} `json:"over_prob,omitempty"`
+	UnderProb   *struct{} `json:"under_prob,omitempty"`
+	OverUS      *struct{} `json:"over_odds_american,omitempty"`
+	UnderUS     *struct{} `json:"under_odds_american,omitempty"`
+}
+
+// UnmarshalJSON defaults AllowDraw and BettingOpen to true and MaxPoolShare
+// to 1 so snapshots written before those fields existed load unchanged.
+func (g *Game) UnmarshalJSON(b []byte) error {
+	type plain Game
+	p := plain{AllowDraw: true, MaxPoolShare: 1, BettingOpen: true}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	*g = Game(p)
+	return nil
+}
+
+// gameWith encodes g with extra top-level fields appended, for responses
+// that report something alongside the game itself.
+func gameWith(g *Game, extra map[string]any) json.RawMessage {
+	b, err := json.Marshal(g)
+	if err != nil {
+		return nil
+	}
+	more, err := json.Marshal(extra)
+	if err != nil || len(more) <= 2 {
+		return b
+	}
+	// splice {"a":1} + {"b":2} into {"a":1,"b":2}
+	return append(append(b[:len(b)-1], ','), more[1:]...)
+}
+
+// oddsConfig controls how addOdds prices a game.
+type oddsConfig struct {
+	// margin is the bookmaker's overround: implied probabilities are
+	// scaled by (1 + margin) before being turned into odds, so they sum
+	// to 1 + margin and the displayed odds sit below the fair pool odds.
+	margin float64
+
+	// roundOdds rounds displayed odds to standard betting increments
+	// (see roundToIncrement). Probabilities are left unrounded.
+	roundOdds bool
+
+	// decimals is how many decimal places displayed odds are rounded to,
+	// half up. Probabilities are left unrounded. 0 leaves odds as they
+	// are.
+	decimals int
+}
+
+// addOdds fills in the total pool and, for each outcome, its raw pool share
+// (pool / total), its implied probability (the share inflated by oc.margin)
+// and decimal odds (1 / implied probability, i.e. the return per token
+// staked). With no margin the odds are exactly total / pool. An outcome with
+// an empty pool gets 0 everywhere rather than +Inf odds. Over and under are
+// priced against their own pool.
+func addOdds(g *Game, oc oddsConfig) {
+	total := float64(g.HomePool + g.AwayPool + g.DrawPool)
+	g.HomeOdds, g.HomeProb, g.HomePoolShare = priceOutcome(g.HomePool, total, oc)
+	g.AwayOdds, g.AwayProb, g.AwayPoolShare = priceOutcome(g.AwayPool, total, oc)
+	g.DrawOdds, g.DrawProb, g.DrawPoolShare = priceOutcome(g.DrawPool, total, oc)
+
+	totals := float64(g.OverPool + g.UnderPool)
+	g.OverOdds, g.OverProb, _ = priceOutcome(g.OverPool, totals, oc)
+	g.UnderOdds, g.UnderProb, _ = priceOutcome(g.UnderPool, totals, oc)
+
+	if g.FixedOdds {
+		g.HomeOdds, g.HomeProb = fixedPrice(g.FixedHomeOdds)
+		g.AwayOdds, g.AwayProb = fixedPrice(g.FixedAwayOdds)
+		g.DrawOdds, g.DrawProb = fixedPrice(g.FixedDrawOdds)
+	}
+
+	drawProb := g.DrawProb
+	if !g.AllowDraw {
+		drawProb = 0
+	}
+	if sum := g.HomeProb + g.AwayProb + drawProb; sum > 0 {
+		g.HomeImplied, g.AwayImplied, g.DrawImplied = g.HomeProb/sum, g.AwayProb/sum, drawProb/sum
+	} else {
+		g.HomeImplied, g.AwayImplied, g.DrawImplied = 0, 0, 0
+	}
+
+	g.TotalPool = g.poolTotal()
+}
+
+// fixedPrice returns preset decimal odds and the probability they imply,
+// or zeros for a selection that has none.
+func fixedPrice(odds float64) (float64, float64) {
+	if odds <= 0 {
+		return 0, 0
+	}
+	return odds, 1 / odds
+}
+
+func priceOutcome(pool Tokens, total float64, oc oddsConfig) (odds, prob, share float64) {
+	if pool <= 0 || total <= 0 {
+		return 0, 0, 0
+	}
+	share = float64(pool) / total
+	prob = share * (1 + oc.margin)
+	odds = 1 / prob
+	if oc.roundOdds {
+		odds = roundToIncrement(odds)
+	}
+	if oc.decimals > 0 {
+		odds = roundHalfUp(odds, oc.decimals)
+	}
+	return odds, prob, share
+}
+
+// roundHalfUp rounds x, which must not be negative, to decimals places with
+// ties going up. A tie is judged on the scaled value with a little slack, so
+// an x like 1.005, stored as 1.00499999..., still counts as one.
+func roundHalfUp(x float64, decimals int) float64 {
+	scale := math.Pow10(decimals)
+	scaled := x * scale
+	whole := math.Floor(scaled)
+	if scaled-whole >= 0.5-1e-9 {
+		whole++
+	}
+	return whole / scale
+}
+
+// oddsIncrements is the ladder decimal odds are rounded to: odds below
+// upTo snap to the nearest step.
+var oddsIncrements = []struct{ upTo, step float64 }{
+	{3, 0.05},
+	{10, 0.1},
+	{20, 0.5},
+	{50, 1},
+	{math.Inf(1), 5},
+}
+
+// minRoundedOdds is the floor for rounded odds, so a near-certain outcome
+// never rounds down to an even-money-or-worse 1.00.
+const minRoundedOdds = 1.01
+
+// roundToIncrement rounds decimal odds to the nearest step of their band in
+// oddsIncrements, never below minRoundedOdds.
+func roundToIncrement(odds float64) float64 {
+	for _, inc := range oddsIncrements {
+		if odds < inc.upTo {
+			// the second rounding strips float noise such as 1.9000000000000001
+			odds = math.Round(math.Round(odds/inc.step)*inc.step*100) / 100
+			break
+		}
+	}
+	return math.Max(odds, minRoundedOdds)
+}
+
+// addAmericanOdds fills in the moneyline form of each of g's decimal odds.
+func addAmericanOdds(g *Game) {
+	g.HomeOddsAmerican = americanOdds(g.HomeOdds)
+	g.AwayOddsAmerican = americanOdds(g.AwayOdds)
+	g.DrawOddsAmerican = americanOdds(g.DrawOdds)
+	g.OverOddsAmerican = americanOdds(g.OverOdds)
+	g.UnderOddsAmerican = americanOdds(g.UnderOdds)
+}
+
+// americanOdds converts decimal odds to moneyline: +150 is the profit on a
+// 100 stake for odds of 2.0 and up, -200 the stake needed to win 100 below
+// that. Odds of 1.0 or less have no moneyline form and give "".
+func americanOdds(decimal float64) string {
+	switch {
+	case decimal >= 2:
+		return fmt.Sprintf("+%.0f", (decimal-1)*100)
+	case decimal > 1:
+		return fmt.Sprintf("-%.0f", 100/(decimal-1))
+	}
+	return ""
+}
+
+// wantAmericanOdds reads the odds_format query param, which may be
+// "decimal" (the default) or "american".
+func wantAmericanOdds(r *http.Request) (bool, error) {
+	switch r.URL.Query().Get("odds_format") {
+	case "", "decimal":
+		return false, nil
+	case "american":
+		return true, nil
+	}
+	return false, fmt.Errorf("bad_odds_format")
+}
+
+// requestedOdds reads the odds query param: "book" prices games with the
+// configured margin and "fair" without it, as pure pool odds. The default is
+// book, which is the same as fair when no margin is configured.
+func requestedOdds(r *http.Request) (oddsConfig, error) {
+	oc := st.odds
+	switch r.URL.Query().Get("odds") {
+	case "", "book":
+		return oc, nil
+	case "fair":
+		oc.margin = 0
+		return oc, nil
+	}
+	return oc, fmt.Errorf("bad_odds")
+}
+
+// poolFor returns the tokens staked on sel.
+func (g *Game) poolFor(sel Selection) Tokens {
+	switch sel {
+	case SelHome:
+		return g.HomePool
+	case SelAway:
+		return g.AwayPool
+	case SelDraw:
+		return g.DrawPool
+	case SelOver:
+		return g.OverPool
+	case SelUnder:
+		return g.UnderPool
+	}
+	return 0
+}
+
+// fixedOddsFor returns the preset odds of sel on a fixed-odds game.
+func (g *Game) fixedOddsFor(sel Selection) float64 {
+	switch sel {
+	case SelHome:
+		return g.FixedHomeOdds
+	case SelAway:
+		return g.FixedAwayOdds
+	case SelDraw:
+		return g.FixedDrawOdds
+	}
+	return 0
+}
+
+// oddsFor returns the decimal odds addOdds computed for sel.
+func (g *Game) oddsFor(sel Selection) float64 {
+	switch sel {
+	case SelHome:
+		return g.HomeOdds
+	case SelAway:
+		return g.AwayOdds
+	case SelDraw:
+		return g.DrawOdds
+	case SelOver:
+		return g.OverOdds
+	case SelUnder:
+		return g.UnderOdds
+	}
+	return 0
+}
+
+// marketFor returns the settled result and total stake of the market sel
+// belongs to. The result is nil if the game was voided or, for over/under,
+// if the score landed exactly on the line.
+func (g *Game) marketFor(sel Selection) (*Selection, Tokens) {
+	if !sel.isTotals() {
+		return g.Result, g.HomePool + g.AwayPool + g.DrawPool
+	}
+	total := g.OverPool + g.UnderPool
+	if g.Result == nil || g.TotalPoints == nil {
+		return nil, total
+	}
+	var result Selection
+	switch {
+	case *g.TotalPoints > g.TotalsLine:
+		result = SelOver
+	case *g.TotalPoints < g.TotalsLine:
+		result = SelUnder
+	default:
+		return nil, total
+	}
+	return &result, total
+}
+
+// poolTotal is everything staked on g across all its markets.
+func (g *Game) poolTotal() Tokens {
+	return g.HomePool + g.AwayPool + g.DrawPool + g.OverPool + g.UnderPool
+}
+
+// addStake adds stake to the pool of sel.
+func (g *Game) addStake(sel Selection, stake Tokens) {
+	switch sel {
+	case SelHome:
+		g.HomePool += stake
+	case SelAway:
+		g.AwayPool += stake
+	case SelDraw:
+		g.DrawPool += stake
+	case SelOver:
+		g.OverPool += stake
+	case SelUnder:
+		g.UnderPool += stake
+	}
+}
+
+// breachesPoolShare reports whether staking stake on sel would push its
+// pool past g.MaxPoolShare of its market. The first stake in an empty
+// market is always allowed, since any bet there holds the whole pool.
+func (g *Game) breachesPoolShare(sel Selection, stake Tokens) bool {
+	_, total := g.marketFor(sel)
+	if g.MaxPoolShare >= 1 || total == 0 {
+		return false
+	}
+	return float64(g.poolFor(sel)+stake) > g.MaxPoolShare*float64(total+stake)
+}
+
+// closed reports whether g has been settled or voided, i.e. no longer takes
+// bets or changes.
+func (g *Game) closed() bool {
+	return g.Status == StatusDone || g.Status == StatusVoid
+}
+
+// won reports whether a bet on sel won once g has settled.
+func (g *Game) won(sel Selection) bool {
+	result, _ := g.marketFor(sel)
+	return result != nil && *result == sel
+}
+
+// configFromEnv builds the store config from the environment: ADMIN_KEY
+// sets the admin key, ADMIN_KEYS (comma-separated key:role pairs) adds keys
+// limited to a role, SEED_DEMO=true loads the demo data, TOKEN_SYMBOL
+// (default tokens) what clients call the default currency,
+// MIN_BETS_TO_SETTLE how many bets a game needs to be settled rather than
+// voided, DRAWS_ENABLED=false turns off draws on every game,
+// PAYOUT_ROUNDING how winners' shares are rounded (floor, round or ceil),
+// HOUSE_CUT the fraction of each settled pool the house keeps,
+// STAKE_IN_RETURN=false reports winners' stakes apart from their payouts,
+// ODDS_MARGIN the overround on displayed odds,
+// ROUND_ODDS whether they are rounded to betting increments, ODDS_DECIMALS
+// (default 2) how many decimal places they keep,
+// AUTO_CREATE_WALLETS and SIGNUP_BONUS whether new users get a wallet (and
+// how many tokens) on their first bet, OPERATOR_KEYS (comma-separated) who
+// may bet on behalf of others, BET_RATE_LIMIT_PER_MINUTE throttles
+// bet placement per IP, CORS_ALLOWED_ORIGINS (comma-separated, or *) which
+// browser origins may call the API, WEBHOOK_URL receives settlement events,
+// SNAPSHOT_PATH enables persistence and SNAPSHOT_INTERVAL_SECONDS
+// (default 10) sets how often it is flushed. STALE_GAME_GRACE_MINUTES turns
+// on voiding of games left unsettled that long after they start, checked
+// every STALE_SWEEP_INTERVAL_SECONDS (default 60), and MAX_GAMES caps how
+// many games are kept in memory. Setting OTEL_EXPORTER_OTLP_ENDPOINT (or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT) sends traces there over OTLP/HTTP.
+func configFromEnv() storeConfig {
+	cfg := storeConfig{
+		adminKey:      os.Getenv("ADMIN_KEY"),
+		snapshotPath:  os.Getenv("SNAPSHOT_PATH"),
+		snapshotEvery: 10 * time.Second,
+	}
+	if v := os.Getenv("ODDS_MARGIN"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 {
+			cfg.margin = f
+		} else {
+			log.Printf("config: ignoring bad ODDS_MARGIN %q", v)
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("TOKEN_SYMBOL")); v != "" {
+		cfg.tokenSymbol = v
+	}
+	if v := os.Getenv("SEED_DEMO"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.seedDemo = b
+		} else {
+			log.Printf("config: ignoring bad SEED_DEMO %q", v)
+		}
+	}
+	if v := os.Getenv("MIN_BETS_TO_SETTLE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			cfg.minBets = n
+		} else {
+			log.Printf("config: ignoring bad MIN_BETS_TO_SETTLE %q", v)
+		}
+	}
+	if v := os.Getenv("DRAWS_ENABLED"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.disableDraws = !b
+		} else {
+			log.Printf("config: ignoring bad DRAWS_ENABLED %q", v)
+		}
+	}
+	if v := os.Getenv("PAYOUT_ROUNDING"); v != "" {
+		if m := roundingMode(v); m.valid() {
+			cfg.rounding = m
+		} else {
+			log.Printf("config: ignoring bad PAYOUT_ROUNDING %q", v)
+		}
+	}
+	if v := os.Getenv("HOUSE_CUT"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 && f < 1 {
+			cfg.houseCut = f
+		} else {
+			log.Printf("config: ignoring bad HOUSE_CUT %q", v)
+		}
+	}
+	if v := os.Getenv("STAKE_IN_RETURN"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.excludeStake = !b
+		} else {
+			log.Printf("config: ignoring bad STAKE_IN_RETURN %q", v)
+		}
+	}
+	if v := os.Getenv("ADMIN_KEYS"); v != "" {
+		cfg.adminRoles = map[string]adminRole{}
+		for _, entry := range strings.Split(v, ",") {
+			key, role, _ := strings.Cut(strings.TrimSpace(entry), ":")
+			if key == "" || !adminRole(role).valid() {
+				log.Printf("config: ignoring bad ADMIN_KEYS entry with role %q", role)
+				continue
+			}
+			cfg.adminRoles[key] = adminRole(role)
+		}
+	}
+	if v := os.Getenv("OPERATOR_KEYS"); v != "" {
+		cfg.operatorKeys = strings.Split(v, ",")
+	}
+	if v := os.Getenv("CORS_ALLOWED_ORIGINS"); v != "" {
+		cfg.allowedOrigins = strings.Split(v, ",")
+	}
+	if v := os.Getenv("ROUND_ODDS"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.roundOdds = b
+		} else {
+			log.Printf("config: ignoring bad ROUND_ODDS %q", v)
+		}
+	}
+	if v := os.Getenv("ODDS_DECIMALS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 10 {
+			cfg.oddsDecimals = n
+		} else {
+			log.Printf("config: ignoring bad ODDS_DECIMALS %q", v)
+		}
+	}
+	if v := os.Getenv("AUTO_CREATE_WALLETS"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			cfg.autoWallets = b
+		} else {
+			log.Printf("config: ignoring bad AUTO_CREATE_WALLETS %q", v)
+		}
+	}
+	if v := os.Getenv("SIGNUP_BONUS"); v != "" {
+		if n, err := parseTokens(v); err == nil && n >= 0 {
+			cfg.signupBonus = n
+		} else {
+			log.Printf("config: ignoring bad SIGNUP_BONUS %q", v)
+		}
+	}
+	if v := os.Getenv("WEBHOOK_URL"); v != "" {
+		if checkWebhookURL(v) == nil {
+			cfg.webhookURL = v
+		} else {
+			log.Printf("config: ignoring bad WEBHOOK_URL %q", v)
+		}
+	}
+	if v := os.Getenv("BET_RATE_LIMIT_PER_MINUTE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			cfg.betsPerMinute = n
+		} else {
+			log.Printf("config: ignoring bad BET_RATE_LIMIT_PER_MINUTE %q", v)
+		}
+	}
+	if v := os.Getenv("SNAPSHOT_INTERVAL_SECONDS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			cfg.snapshotEvery = time.Duration(n) * time.Second
+		} else {
+			log.Printf("config: ignoring bad SNAPSHOT_INTERVAL_SECONDS %q", v)
+		}
+	}
+	if v := os.Getenv("STALE_GAME_GRACE_MINUTES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			cfg.staleAfter = time.Duration(n) * time.Minute
+		} else {
+			log.Printf("config: ignoring bad STALE_GAME_GRACE_MINUTES %q", v)
+		}
+	}
+	if v := os.Getenv("MAX_GAMES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			cfg.maxGames = n
+		} else {
+			log.Printf("config: ignoring bad MAX_GAMES %q", v)
+		}
+	}
+	if v := os.Getenv("STALE_SWEEP_INTERVAL_SECONDS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			cfg.sweepEvery = time.Duration(n) * time.Second
+		} else {
+			log.Printf("config: ignoring bad STALE_SWEEP_INTERVAL_SECONDS %q", v)
+		}
+	}
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+		if t, err := otlpTracer(); err == nil {
+			cfg.tracer = t
+		} else {
+			log.Printf("config: tracing off: %v", err)
+		}
+	}
+	return cfg
+}
+
+// newBetID returns a random positive 63-bit ID not used by any bet.
+// Random IDs don't reveal how many bets have been placed and can't collide
+// with bets from before a restart. Callers must hold s.mu.
+func (s *store) newBetID() int64 {
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			panic(err)
+		}
+		id := int64(binary.BigEndian.Uint64(b[:]) >> 1)
+		if _, taken := s.bets[id]; id != 0 && !taken {
+			return id
+		}
+	}
+}
+
+func randomKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// keyFingerprint identifies key in logs without revealing it.
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+var st = newStore(configFromEnv())
+
+// ---------------- Vercel entry (single function) ----------------
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	withRequestLog(withSpan(withGzip(http.HandlerFunc(dispatch)))).ServeHTTP(w, r)
+}
+
+func dispatch(w http.ResponseWriter, r *http.Request) {
+	// Health checks and metrics scrapes come from monitors, not browsers,
+	// so they skip CORS.
+	switch strings.TrimPrefix(r.URL.Query().Get("path"), "/") {
+	case "healthz":
+		handleHealthz(w, r)
+		return
+	case "metrics":
+		handleMetrics(w, r)
+		return
+	}
+
+	// CORS + dispatch using the original path passed via rewrite (?path=...)
+	allowCORS(withTimeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rel := strings.TrimPrefix(r.URL.Query().Get("path"), "/") // e.g., "games", "games/101/bets"
+		switch {
+		case rel == "games" || rel == "games/":
+			handleGames(w, r)
+			return
+
+		case strings.HasPrefix(rel, "games/"):
+			rest := strings.TrimPrefix(rel, "games/")
+			// handleGameByID expects URL.Path like /api/games/<rest>
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = "/api/games/" + rest
+			handleGameByID(w, r2)
+			return
+
+		case strings.HasPrefix(rel, "users/"):
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = "/api/users/" + strings.TrimPrefix(rel, "users/")
+			handleUserByID(w, r2)
+			return
+
+		case strings.HasPrefix(rel, "admin/"):
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = "/api/admin/" + strings.TrimPrefix(rel, "admin/")
+			handleAdmin(w, r2)
+			return
+
+		case strings.HasPrefix(rel, "bets/"):
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = "/api/bets/" + strings.TrimPrefix(rel, "bets/")
+			handleBetByID(w, r2)
+			return
+
+		case rel == "leaderboard":
+			handleLeaderboard(w, r)
+			return
+
+		case rel == "results":
+			handleResults(w, r)
+			return
+
+		case rel == "openapi.json":
+			handleOpenAPI(w, r)
+			return
+
+		case rel == "betslip":
+			st.betLimiter.middleware(http.HandlerFunc(handleBetSlip)).ServeHTTP(w, r)
+			return
+
+		case strings.HasPrefix(rel, "wallets/"):
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = "/api/wallets/" + strings.TrimPrefix(rel, "wallets/")
+			handleWalletByID(w, r2)
+			return
+
+		default:
+			writeError(w, http.StatusNotFound, "not_found")
+			return
+		}
+	}))).ServeHTTP(w, r)
+}
+
+// ---------------- helpers & handlers ----------------
+
+// allowCORS lets the browser origins in st.allowedOrigins call the API.
+// Other origins get no Access-Control-Allow-Origin header, so browsers
+// refuse them; with a "*" entry any origin is allowed.
+func allowCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch origin := r.Header.Get("Origin"); {
+		case st.allowedOrigins["*"]:
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		case origin != "" && st.allowedOrigins[origin]:
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		}
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Admin-Key, X-Admin-Signature, X-Operator-Key, Idempotency-Key, X-User-ID, If-None-Match")
+		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,DELETE,OPTIONS")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, ETag, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset")
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, st.stats())
+}
+
+// storeMetrics are running totals since the instance started. They are
+// atomics so GET metrics can read them without taking s.mu.
+type storeMetrics struct {
+	betsPlaced   atomic.Int64
+	stakeVolume  atomic.Int64 // millitokens
+	gamesSettled atomic.Int64
+	payouts      atomic.Int64 // millitokens
+}
+
+// openPool is everything staked on games that are still open.
+func (s *store) openPool() Tokens {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var total Tokens
+	for _, g := range s.games {
+		if !g.closed() {
+			total += g.poolTotal()
+		}
+	}
+	return total
+}
+
+// handleMetrics serves the store's counters in the Prometheus text
+// exposition format. Like healthz it is meant for scrapers, not browsers.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+	m := &st.metrics
+	metrics := []struct {
+		name, kind, help string
+		value            string
+	}{
+		{"impredict_bets_placed_total", "counter", "Bets placed.", strconv.FormatInt(m.betsPlaced.Load(), 10)},
+		{"impredict_stake_tokens_total", "counter", "Tokens staked on placed bets.", Tokens(m.stakeVolume.Load()).String()},
+		{"impredict_games_settled_total", "counter", "Games settled.", strconv.FormatInt(m.gamesSettled.Load(), 10)},
+		{"impredict_payout_tokens_total", "counter", "Tokens paid out at settlement.", Tokens(m.payouts.Load()).String()},
+		{"impredict_open_pool_tokens", "gauge", "Tokens in the pools of games not yet settled or voided.", st.openPool().String()},
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, mt := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", mt.name, mt.help, mt.name, mt.kind, mt.name, mt.value)
+	}
+}
+
+// requestTimeout bounds how long a request may wait on the store.
+const requestTimeout = 10 * time.Second
+
+// withTimeout gives each request a context that expires after
+// requestTimeout, so store calls stuck behind the lock give up with 503
+// timeout instead of holding the function open.
+func withTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// maxGamesPage is the largest page GET games will return.
+const maxGamesPage = 100
+
+// parseIDs reads a comma-separated list of game IDs, dropping repeats. It
+// reports false if any isn't a number or there are more than maxGamesPage.
+func parseIDs(v string) ([]int64, bool) {
+	var ids []int64
+	seen := map[int64]bool{}
+	for _, f := range strings.Split(v, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(f), 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, len(ids) <= maxGamesPage
+}
+
+func handleGames(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && r.URL.Query().Has("ids") {
+		handleGamesByID(w, r)
+		return
+	}
+	if r.Method == http.MethodGet {
+		q := r.URL.Query()
+		f := gameFilter{
+			sport:  q.Get("sport"),
+			status: GameStatus(q.Get("status")),
+			limit:  maxGamesPage,
+		}
+		var ok bool
+		if f.limit, ok = queryCount(q, "limit", f.limit); !ok {
+			writeError(w, http.StatusBadRequest, "bad_limit")
+			return
+		}
+		if f.offset, ok = queryCount(q, "offset", 0); !ok {
+			writeError(w, http.StatusBadRequest, "bad_offset")
+			return
+		}
+		if f.limit == 0 || f.limit > maxGamesPage {
+			f.limit = maxGamesPage
+		}
+		if f.from, ok = queryTime(q, "from"); !ok {
+			writeError(w, http.StatusBadRequest, "bad_from")
+			return
+		}
+		if f.to, ok = queryTime(q, "to"); !ok {
+			writeError(w, http.StatusBadRequest, "bad_to")
+			return
+		}
+		if !f.from.IsZero() && !f.to.IsZero() && f.from.After(f.to) {
+			writeError(w, http.StatusBadRequest, "bad_range")
+			return
+		}
+		american, err := wantAmericanOdds(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		oc, err := requestedOdds(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if notModified(w, r, st.etag()) {
+			return
+		}
+		games, total := st.listGamesFiltered(f)
+		for _, g := range games {
+			addOdds(g, oc)
+			if american {
+				addAmericanOdds(g)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"games":  games,
+			"total":  total,
+			"limit":  f.limit,
+			"offset": f.offset,
+		})
+		return
+	}
+	if r.Method == http.MethodPost {
+		key, err := adminKey(r)
+		if err != nil {
+			writeError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		var body gameSpec
+		if !decodeBody(w, r, &body) {
+			return
+		}
+		g, err := st.createGame(key, body)
+		if err != nil {
+			code := http.StatusBadRequest
+			if err.Error() == "forbidden" {
+				code = http.StatusForbidden
+			}
+			writeError(w, code, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, g)
+		return
+	}
+	writeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+}
+
+// settleRequest is the body of POST games/{id}/settle.
+type settleRequest struct {
+	Result      Selection `json:"result"`
+	TotalPoints *float64  `json:"total_points"`
+	HomeScore   *int      `json:"home_score"`
+	AwayScore   *int      `json:"away_score"`
+}
+
+// handleGamesByID serves GET games?ids=101,102: the games asked for, in
+// that order, and the IDs of any that don't exist.
+func handleGamesByID(w http.ResponseWriter, r *http.Request) {
+	ids, ok := parseIDs(r.URL.Query().Get("ids"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_ids")
+		return
+	}
+	american, err := wantAmericanOdds(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	oc, err := requestedOdds(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if notModified(w, r, st.etag()) {
+		return
+	}
+	games, missing := st.getGames(ids)
+	for _, g := range games {
+		addOdds(g, oc)
+		if american {
+			addAmericanOdds(g)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"games": games, "missing": missing})
+}
+
+func handleGameByID(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/games/"), "/")
+	if len(parts) == 0 || parts[0] == "" {
+		writeError(w, http.StatusNotFound, "not_found")
+		return
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_id")
+		return
+	}
+
+	if len(parts) == 1 && r.Method == http.MethodGet {
+		american, err := wantAmericanOdds(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		oc, err := requestedOdds(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		// With ?user_id= the game comes with that user's position on it.
+		var userID int64
+		if v := r.URL.Query().Get("user_id"); v != "" {
+			if userID, err = strconv.ParseInt(v, 10, 64); err != nil {
+				writeError(w, http.StatusBadRequest, "bad_user_id")
+				return
+			}
+		}
+		tag := st.etag()
+		var (
+			g   *Game
+			pos *userPosition
+			ok  bool
+		)
+		if userID != 0 {
+			g, pos, ok = st.getGameFor(id, userID)
+		} else {
+			g, ok = st.getGame(id)
+		}
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found")
+			return
+		}
+		if notModified(w, r, tag) {
+			return
+		}
+		addOdds(g, oc)
+		if american {
+			addAmericanOdds(g)
+		}
+		if pos != nil {
+			writeJSON(w, http.StatusOK, gameWith(g, map[string]any{"user": pos}))
+			return
+		}
+		writeJSON(w, http.StatusOK, g)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "bets" && r.Method == http.MethodGet {
+		bets, ok := st.listBetsByGame(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found")
+			return
+		}
+		// Only admins see who placed each bet.
+		if key, err := adminKey(r); err != nil || !st.isAdmin(key) {
+			for _, b := range bets {
+				b.UserID = 0
+			}
+		}
+		writeJSON(w, http.StatusOK, bets)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "bets" && r.Method == http.MethodPost {
+		st.betLimiter.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlePlaceBet(w, r, id)
+		})).ServeHTTP(w, r)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "quote" && r.Method == http.MethodGet {
+		q := r.URL.Query()
+		stake, err := parseTokens(q.Get("stake"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_stake")
+			return
+		}
+		quote, err := st.quote(id, Selection(q.Get("selection")), stake)
+		if err != nil {
+			code := http.StatusBadRequest
+			switch err.Error() {
+			case "game_not_found":
+				code = http.StatusNotFound
+			case "game_settled":
+				code = http.StatusConflict
+			}
+			writeError(w, code, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, quote)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "impact" && r.Method == http.MethodGet {
+		q := r.URL.Query()
+		stake, err := parseTokens(q.Get("stake"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_stake")
+			return
+		}
+		oc, err := requestedOdds(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		sel := Selection(q.Get("selection"))
+		moves, err := st.impact(id, sel, stake, oc)
+		if err != nil {
+			code := http.StatusBadRequest
+			switch err.Error() {
+			case "game_not_found":
+				code = http.StatusNotFound
+			case "game_settled":
+				code = http.StatusConflict
+			}
+			writeError(w, code, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"selection": sel, "stake_tokens": stake, "odds": moves})
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "settle" && r.Method == http.MethodPost {
+		// Cap the body before adminKey reads it to check a signature.
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+		key, err := adminKey(r)
+		if err != nil {
+			code := http.StatusForbidden
+			if err.Error() == "request_too_large" {
+				code = http.StatusRequestEntityTooLarge
+			}
+			writeError(w, code, err.Error())
+			return
+		}
+		var body settleRequest
+		if !decodeBody(w, r, &body) {
+			return
+		}
+		// A final score, when given, decides the result (and the total
+		// points, unless they're sent too) in place of an explicit result.
+		var score *Score
+		if body.HomeScore != nil || body.AwayScore != nil {
+			if body.HomeScore == nil || body.AwayScore == nil || *body.HomeScore < 0 || *body.AwayScore < 0 {
+				writeError(w, http.StatusBadRequest, "bad_score")
+				return
+			}
+			score = &Score{Home: *body.HomeScore, Away: *body.AwayScore}
+			body.Result = score.result()
+			if body.TotalPoints == nil {
+				total := float64(score.Home + score.Away)
+				body.TotalPoints = &total
+			}
+		}
+		if !isResult(body.Result) {
+			writeError(w, http.StatusBadRequest, "bad_selection")
+			return
+		}
+		if r.URL.Query().Get("dry_run") == "true" {
+			payouts, houseTake, voided, pushed, err := st.previewSettle(r.Context(), key, id, body.Result, body.TotalPoints, score)
+			if err != nil {
+				code := http.StatusForbidden
+				switch err.Error() {
+				case "draw_not_allowed", "missing_total_points":
+					code = http.StatusBadRequest
+				case "timeout":
+					code = http.StatusServiceUnavailable
+				}
+				writeError(w, code, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{
+				"dry_run":                    true,
+				"payouts":                    payouts,
+				"house_take_tokens":          houseTake,
+				"voided_insufficient_action": voided && !pushed,
+				"pushed":                     pushed,
+			})
+			return
+		}
+		settle := st.settle
+		if r.URL.Query().Get("force") == "true" {
+			settle = st.resettle
+		}
+		g, houseTake, err := settle(r.Context(), key, id, body.Result, body.TotalPoints, score)
+		if err != nil {
+			code := http.StatusForbidden
+			switch err.Error() {
+			case "draw_not_allowed", "missing_total_points":
+				code = http.StatusBadRequest
+			case "not_settled", "cannot_resettle":
+				code = http.StatusConflict
+			case "timeout":
+				code = http.StatusServiceUnavailable
+			}
+			writeError(w, code, err.Error())
+			return
+		}
+
+		// >>> CHANGE #2: compute fresh odds in the response
+		gc := *g
+		addOdds(&gc, st.odds)
+		writeJSON(w, http.StatusOK, gameWith(&gc, map[string]any{
+			"house_take_tokens":          houseTake,
+			"voided_insufficient_action": g.Status == StatusVoid && !g.pushed(),
+			"pushed":                     g.pushed(),
+		}))
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "stream" && r.Method == http.MethodGet {
+		serveOddsStream(w, r, id)
+		return
+	}
+
+	if len(parts) == 2 && (parts[1] == "suspend" || parts[1] == "resume") && r.Method == http.MethodPost {
+		key, err := adminKey(r)
+		if err != nil {
+			writeError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		g, err := st.setBettingOpen(r.Context(), key, id, parts[1] == "resume")
+		if err != nil {
+			code := http.StatusBadRequest
+			switch err.Error() {
+			case "forbidden":
+				code = http.StatusForbidden
+			case "game_not_found":
+				code = http.StatusNotFound
+			case "game_settled":
+				code = http.StatusConflict
+			case "timeout":
+				code = http.StatusServiceUnavailable
+			}
+			writeError(w, code, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, g)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "void" && r.Method == http.MethodPost {
+		key, err := adminKey(r)
+		if err != nil {
+			writeError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		g, users, refunded, err := st.voidGame(r.Context(), key, id)
+		if err != nil {
+			code := http.StatusBadRequest
+			switch err.Error() {
+			case "forbidden":
+				code = http.StatusForbidden
+			case "timeout":
+				code = http.StatusServiceUnavailable
+			}
+			writeError(w, code, err.Error())
+			return
+		}
+
+		gc := *g
+		addOdds(&gc, st.odds)
+		writeJSON(w, http.StatusOK, map[string]any{
+			"game":              &gc,
+			"refunded_user_ids": users,
+			"refunded_tokens":   refunded,
+		})
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "reopen" && r.Method == http.MethodPost {
+		key, err := adminKey(r)
+		if err != nil {
+			writeError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		g, err := st.reopenGame(key, id)
+		var re *reopenError
+		switch {
+		case errors.As(err, &re):
+			writeJSON(w, http.StatusConflict, map[string]any{"error": re.Error(), "short_user_ids": re.users})
+			return
+		case err != nil:
+			code := http.StatusBadRequest
+			switch err.Error() {
+			case "forbidden":
+				code = http.StatusForbidden
+			case "game_not_found":
+				code = http.StatusNotFound
+			case "not_voided":
+				code = http.StatusConflict
+			}
+			writeError(w, code, err.Error())
+			return
+		}
+		gc := *g
+		addOdds(&gc, st.odds)
+		writeJSON(w, http.StatusOK, &gc)
+		return
+	}
+
+	writeError(w, http.StatusNotFound, "not_found")
+}
+
+// betRequest is the body of POST games/{id}/bets.
+type betRequest struct {
+	UserID    int64     `json:"user_id"`
+	Selection Selection `json:"selection"`
+	Stake     Tokens    `json:"stake"`
+	MinOdds   float64   `json:"min_odds"`
+	Currency  string    `json:"currency"`
+
+	// AllIn stakes the user's whole balance; Stake must then be left out.
+	AllIn bool `json:"all_in"`
+}
+
+// validateBetRequest checks the fields of body that can be judged without
+// the store, all in one pass, and returns a message for each bad one keyed
+// by its JSON name. It returns nil if there are none.
+func validateBetRequest(body betRequest) map[string]string {
+	fields := map[string]string{}
+	if body.UserID <= 0 {
+		fields["user_id"] = "must be positive"
+	}
+	if !isValidSelection(body.Selection) {
+		fields["selection"] = "unknown"
+	}
+	switch {
+	case body.AllIn && body.Stake != 0:
+		fields["stake"] = "must be left out with all_in"
+	case !body.AllIn && body.Stake <= 0:
+		fields["stake"] = "must be positive"
+	}
+	if body.MinOdds < 0 {
+		fields["min_odds"] = "must not be negative"
+	}
+	if _, err := normalizeCurrency(body.Currency); err != nil {
+		fields["currency"] = "invalid"
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+func handlePlaceBet(w http.ResponseWriter, r *http.Request, id int64) {
+	var body betRequest
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if fields := validateBetRequest(body); fields != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]any{"error": "validation_failed", "fields": fields})
+		return
+	}
+	if body.AllIn {
+		body.Stake = allIn
+	}
+	idemKey := r.Header.Get("Idempotency-Key")
+	place := st.placeBet
+	if opKey := r.Header.Get("X-Operator-Key"); opKey != "" {
+		place = func(ctx context.Context, userID, gameID int64, sel Selection, stake Tokens, minOdds float64, currency, idemKey string) (*Bet, *Wallet, *Game, error) {
+			return st.placeBetAs(ctx, opKey, userID, gameID, sel, stake, minOdds, currency, idemKey)
+		}
+	} else if !actsFor(w, r, body.UserID) {
+		// Only an operator may bet for someone other than the caller.
+		return
+	}
+	b, wlt, g, err := place(r.Context(), body.UserID, id, body.Selection, body.Stake, body.MinOdds, body.Currency, idemKey)
+	if err != nil {
+		code := http.StatusBadRequest
+		switch err.Error() {
+		case "forbidden", "account_suspended":
+			code = http.StatusForbidden
+		case "idempotency_conflict", "odds_moved":
+			code = http.StatusConflict
+		case "timeout":
+			code = http.StatusServiceUnavailable
+		}
+		writeError(w, code, err.Error())
+		return
+	}
+
+	// >>> CHANGE #1: compute fresh odds in the response
+	gc := *g
+	addOdds(&gc, st.odds)
+	writeJSON(w, http.StatusOK, map[string]any{"bet": b, "wallet": wlt, "game": &gc})
+}
+
+// actsFor reports whether the caller may act for userID: an X-User-ID
+// header, when sent, must name them. If not it writes the error response.
+func actsFor(w http.ResponseWriter, r *http.Request, userID int64) bool {
+	if r.Header.Get("X-User-ID") == "" {
+		return true
+	}
+	uid, err := requestUserID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	if uid != userID {
+		writeError(w, http.StatusForbidden, "forbidden")
+		return false
+	}
+	return true
+}
+
+// requireUser is actsFor for requests that move tokens out of userID's
+// wallet to someone else, where the X-User-ID header must be sent: without
+// it the response is 401 unauthenticated.
+func requireUser(w http.ResponseWriter, r *http.Request, userID int64) bool {
+	if r.Header.Get("X-User-ID") == "" {
+		writeError(w, http.StatusUnauthorized, "unauthenticated")
+		return false
+	}
+	return actsFor(w, r, userID)
+}
+
+// slipRequest is the body of POST betslip.
+type slipRequest struct {
+	UserID int64     `json:"user_id"`
+	Bets   []slipBet `json:"bets"`
+}
+
+func handleBetSlip(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+	var body slipRequest
+	if !decodeBody(w, r, &body) || !actsFor(w, r, body.UserID) {
+		return
+	}
+	bets, wlt, failed, err := st.placeBetSlip(r.Context(), body.UserID, body.Bets)
+	if err != nil {
+		code := http.StatusBadRequest
+		switch err.Error() {
+		case "slip_rejected":
+			type failure struct {
+				Index int    `json:"index"`
+				Error string `json:"error"`
+			}
+			failures := make([]failure, 0, len(failed))
+			for i := range body.Bets {
+				if e, ok := failed[i]; ok {
+					failures = append(failures, failure{i, e})
+				}
+			}
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]any{
+				"error":  err.Error(),
+				"failed": failures,
+			})
+			return
+		case "account_suspended":
+			code = http.StatusForbidden
+		case "timeout":
+			code = http.StatusServiceUnavailable
+		}
+		writeError(w, code, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"bets": bets, "wallet": wlt})
+}
+
+func handleUserByID(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/users/"), "/")
+	if len(parts) == 0 || parts[0] == "" {
+		writeError(w, http.StatusNotFound, "not_found")
+		return
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_id")
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "bets" && r.Method == http.MethodGet {
+		q := r.URL.Query()
+		var gameID *int64
+		if v := q.Get("game_id"); v != "" {
+			gid, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "bad_game_id")
+				return
+			}
+			gameID = &gid
+		}
+		bets, ok := st.listBetsByUser(id, gameID)
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found")
+			return
+		}
+		if status := GameStatus(q.Get("status")); status != "" {
+			filtered := make([]*Bet, 0, len(bets))
+			for _, b := range bets {
+				if g, ok := st.getGame(b.GameID); ok && g.Status == status {
+					filtered = append(filtered, b)
+				}
+			}
+			bets = filtered
+		}
+		writeJSON(w, http.StatusOK, bets)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "games" && r.Method == http.MethodGet {
+		positions, ok := st.openPositions(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found")
+			return
+		}
+		out := make([]json.RawMessage, 0, len(positions))
+		for _, p := range positions {
+			out = append(out, gameWith(p.Game, map[string]any{
+				"my_stake_tokens": p.Stake,
+				"my_selections":   p.Selections,
+			}))
+		}
+		writeJSON(w, http.StatusOK, out)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "stats" && r.Method == http.MethodGet {
+		stats, ok := st.userStats(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found")
+			return
+		}
+		writeJSON(w, http.StatusOK, stats)
+		return
+	}
+
+	writeError(w, http.StatusNotFound, "not_found")
+}
+
+// adjustRequest is the body of POST admin/wallets/{id}/adjust.
+type adjustRequest struct {
+	Delta  Tokens `json:"delta"`
+	Reason string `json:"reason"`
+}
+
+// suspendRequest is the body of POST admin/users/{id}/suspend.
+type suspendRequest struct {
+	Suspended bool   `json:"suspended"`
+	Reason    string `json:"reason"`
+}
+
+// webhookRequest is the body of POST admin/webhook; an empty URL turns the
+// webhook off.
+type webhookRequest struct {
+	URL string `json:"url"`
+}
+
+// settleBatchRequest is the body of POST admin/settle-batch.
+type settleBatchRequest struct {
+	Results map[int64]Selection `json:"results"`
+}
+
+// featureRequest is the body of POST admin/games/{id}/feature.
+type featureRequest struct {
+	Rank int `json:"rank"`
+}
+
+// cloneRequest is the body of POST admin/games/{id}/clone.
+type cloneRequest struct {
+	StartTime stringOrNumber `json:"start_time"`
+}
+
+func handleAdmin(w http.ResponseWriter, r *http.Request) {
+	key, err := adminKey(r)
+	if err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if !st.isAdmin(key) {
+		writeError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	rel := strings.TrimPrefix(r.URL.Path, "/api/admin/")
+
+	if rel == "audit" && r.Method == http.MethodGet {
+		report, err := st.auditInvariant()
+		resp := map[string]any{"report": report}
+		if err != nil {
+			resp["error"] = err.Error()
+		}
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	if rel == "reconcile" && r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, st.reconcile())
+		return
+	}
+
+	if rel == "audit-log" && r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, map[string]any{"entries": st.auditEntries()})
+		return
+	}
+
+	if userPart, ok := strings.CutPrefix(rel, "wallets/"); ok && strings.HasSuffix(userPart, "/adjust") && r.Method == http.MethodPost {
+		userID, err := strconv.ParseInt(strings.TrimSuffix(userPart, "/adjust"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_id")
+			return
+		}
+		var body adjustRequest
+		if !decodeBody(w, r, &body) {
+			return
+		}
+		wlt, err := st.adjustBalance(key, userID, body.Delta, body.Reason, clientIP(r))
+		if err != nil {
+			code := http.StatusBadRequest
+			switch err.Error() {
+			case "forbidden":
+				code = http.StatusForbidden
+			case "wallet_not_found":
+				code = http.StatusNotFound
+			case "negative_balance":
+				code = http.StatusConflict
+			}
+			writeError(w, code, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, wlt)
+		return
+	}
+
+	if userPart, ok := strings.CutPrefix(rel, "users/"); ok && strings.HasSuffix(userPart, "/suspend") && r.Method == http.MethodPost {
+		userID, err := strconv.ParseInt(strings.TrimSuffix(userPart, "/suspend"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_id")
+			return
+		}
+		var body suspendRequest
+		if !decodeBody(w, r, &body) {
+			return
+		}
+		wlt, err := st.setSuspended(key, userID, body.Suspended, body.Reason, clientIP(r))
+		if err != nil {
+			code := http.StatusBadRequest
+			switch err.Error() {
+			case "forbidden":
+				code = http.StatusForbidden
+			case "wallet_not_found":
+				code = http.StatusNotFound
+			}
+			writeError(w, code, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, wlt)
+		return
+	}
+
+	if rel == "webhook" && r.Method == http.MethodPost {
+		if !st.hasRole(key, roleSuper) {
+			writeError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+		var body webhookRequest
+		if !decodeBody(w, r, &body) {
+			return
+		}
+		if body.URL != "" {
+			if err := checkWebhookURL(body.URL); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		st.hooks.setURL(body.URL)
+		writeJSON(w, http.StatusOK, map[string]any{"url": body.URL})
+		return
+	}
+
+	if rel == "settle-batch" && r.Method == http.MethodPost {
+		var body settleBatchRequest
+		if !decodeBody(w, r, &body) {
+			return
+		}
+		sum, err := st.ingestResults(r.Context(), body.Results, key)
+		if err != nil {
+			code := http.StatusBadRequest
+			switch err.Error() {
+			case "forbidden":
+				code = http.StatusForbidden
+			case "timeout":
+				code = http.StatusServiceUnavailable
+			}
+			writeJSON(w, code, map[string]any{"error": err.Error(), "summary": sum})
+			return
+		}
+		writeJSON(w, http.StatusOK, sum)
+		return
+	}
+
+	if gamePart, ok := strings.CutPrefix(rel, "games/"); ok && strings.HasSuffix(gamePart, "/feature") && r.Method == http.MethodPost {
+		gameID, err := strconv.ParseInt(strings.TrimSuffix(gamePart, "/feature"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_id")
+			return
+		}
+		var body featureRequest
+		if !decodeBody(w, r, &body) {
+			return
+		}
+		g, err := st.setFeaturedRank(key, gameID, body.Rank)
+		if err != nil {
+			code := http.StatusBadRequest
+			switch err.Error() {
+			case "forbidden":
+				code = http.StatusForbidden
+			case "game_not_found":
+				code = http.StatusNotFound
+			}
+			writeError(w, code, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, g)
+		return
+	}
+
+	if gamePart, ok := strings.CutPrefix(rel, "games/"); ok && strings.HasSuffix(gamePart, "/clone") && r.Method == http.MethodPost {
+		gameID, err := strconv.ParseInt(strings.TrimSuffix(gamePart, "/clone"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_id")
+			return
+		}
+		var body cloneRequest
+		if !decodeBody(w, r, &body) {
+			return
+		}
+		g, err := st.cloneGame(key, gameID, body.StartTime)
+		if err != nil {
+			code := http.StatusBadRequest
+			switch err.Error() {
+			case "forbidden":
+				code = http.StatusForbidden
+			case "game_not_found":
+				code = http.StatusNotFound
+			}
+			writeError(w, code, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, g)
+		return
+	}
+
+	if rel == "games/import" && r.Method == http.MethodPost {
+		if !st.hasRole(key, roleCreate) {
+			writeError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+		rd := csv.NewReader(http.MaxBytesReader(w, r.Body, maxImportBytes))
+		rd.FieldsPerRecord = -1
+		rd.TrimLeadingSpace = true
+		records, err := rd.ReadAll()
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeError(w, http.StatusRequestEntityTooLarge, "request_too_large")
+				return
+			}
+			writeError(w, http.StatusBadRequest, "bad_csv")
+			return
+		}
+		writeJSON(w, http.StatusOK, importGames(key, records))
+		return
+	}
+
+	writeError(w, http.StatusNotFound, "not_found")
+}
+
+// importRow reports what happened to one row of a game import: the game it
+// created, or why it was skipped. Row counts from 1, including any header.
+type importRow struct {
+	Row   int    `json:"row"`
+	Game  *Game  `json:"game,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// importGames creates a game from each of records, CSV rows of the form
+// sport,home,away,start_time, and reports on every row. A leading header
+// row (one starting with "sport") is skipped. A bad row doesn't stop the
+// rows after it.
+func importGames(key string, records [][]string) map[string]any {
+	rows := make([]importRow, 0, len(records))
+	created := 0
+	for i, rec := range records {
+		if i == 0 && len(rec) > 0 && strings.EqualFold(strings.TrimSpace(rec[0]), "sport") {
+			continue
+		}
+		row := importRow{Row: i + 1}
+		if len(rec) != 4 {
+			row.Error = "bad_row"
+			rows = append(rows, row)
+			continue
+		}
+		g, err := st.createGame(key, gameSpec{
+			Sport:     rec[0],
+			Home:      rec[1],
+			Away:      rec[2],
+			StartTime: stringOrNumber(strings.TrimSpace(rec[3])),
+		})
+		if err != nil {
+			row.Error = err.Error()
+		} else {
+			row.Game = g
+			created++
+		}
+		rows = append(rows, row)
+	}
+	return map[string]any{"created": created, "failed": len(rows) - created, "rows": rows}
+}
+
+// cashOutRequest is the body of POST bets/{id}/cashout.
+type cashOutRequest struct {
+	UserID   int64   `json:"user_id"`
+	Fraction float64 `json:"fraction"`
+}
+
+func handleBetByID(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/bets/"), "/")
+	if len(parts) == 0 || parts[0] == "" {
+		writeError(w, http.StatusNotFound, "not_found")
+		return
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_id")
+		return
+	}
+
+	if len(parts) == 1 && r.Method == http.MethodGet {
+		b, ok := st.getBet(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found")
+			return
+		}
+		g, _ := st.getGame(b.GameID)
+		writeJSON(w, http.StatusOK, struct {
+			*Bet
+			Settled bool `json:"settled"`
+		}{b, g != nil && g.closed()})
+		return
+	}
+
+	if len(parts) == 1 && r.Method == http.MethodDelete {
+		userID, err := requestUserID(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		wlt, err := st.cancelBet(userID, id)
+		if err != nil {
+			code := http.StatusConflict
+			switch err.Error() {
+			case "forbidden":
+				code = http.StatusForbidden
+			case "bet_not_found":
+				code = http.StatusNotFound
+			}
+			writeError(w, code, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"wallet": wlt})
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "cashout" && r.Method == http.MethodPost {
+		var body cashOutRequest
+		if !decodeBody(w, r, &body) {
+			return
+		}
+		b, wlt, amount, err := st.cashOut(body.UserID, id, body.Fraction)
+		if err != nil {
+			code := http.StatusBadRequest
+			switch err.Error() {
+			case "forbidden":
+				code = http.StatusForbidden
+			case "bet_not_found":
+				code = http.StatusNotFound
+			}
+			writeError(w, code, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"bet": b, "wallet": wlt, "cashed_out_tokens": amount})
+		return
+	}
+
+	writeError(w, http.StatusNotFound, "not_found")
+}
+
+// maxLeaderboard is the most entries GET leaderboard will return.
+const maxLeaderboard = 100
+
+func handleLeaderboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+	limit, ok := queryCount(r.URL.Query(), "limit", 10)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_limit")
+		return
+	}
+	if limit == 0 || limit > maxLeaderboard {
+		limit = maxLeaderboard
+	}
+	type entry struct {
+		Rank    int    `json:"rank"`
+		UserID  int64  `json:"user_id"`
+		Balance Tokens `json:"tokens_balance"`
+	}
+	entries := []entry{}
+	for i, wlt := range st.topWallets(limit) {
+		entries = append(entries, entry{i + 1, wlt.UserID, wlt.Balance})
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func handleResults(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+	if notModified(w, r, st.etag()) {
+		return
+	}
+	writeJSON(w, http.StatusOK, st.results(r.URL.Query().Get("sport")))
+}
+
+// depositRequest is the body of POST wallets/{id}/deposit.
+type depositRequest struct {
+	Amount   Tokens `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// transferRequest is the body of POST wallets/{id}/transfer.
+type transferRequest struct {
+	To     int64  `json:"to"`
+	Amount Tokens `json:"amount"`
+}
+
+func handleWalletByID(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/wallets/"), "/")
+	if len(parts) == 0 || parts[0] == "" {
+		writeError(w, http.StatusNotFound, "not_found")
+		return
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_id")
+		return
+	}
+
+	if len(parts) == 1 && r.Method == http.MethodGet {
+		wlt, ok := st.getWallet(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found")
+			return
+		}
+		writeJSON(w, http.StatusOK, wlt)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "deposit" && r.Method == http.MethodPost {
+		var body depositRequest
+		if !decodeBody(w, r, &body) {
+			return
+		}
+		wlt, err := st.deposit(id, body.Amount, body.Currency)
+		if err != nil {
+			code := http.StatusBadRequest
+			if err.Error() == "account_suspended" {
+				code = http.StatusForbidden
+			}
+			writeError(w, code, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, wlt)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "transfer" && r.Method == http.MethodPost {
+		var body transferRequest
+		if !decodeBody(w, r, &body) {
+			return
+		}
+		if !requireUser(w, r, id) {
+			return
+		}
+		from, to, err := st.transfer(id, body.To, body.Amount)
+		if err != nil {
+			code := http.StatusBadRequest
+			switch err.Error() {
+			case "wallet_not_found":
+				code = http.StatusNotFound
+			case "insufficient_balance":
+				code = http.StatusConflict
+			case "account_suspended":
+				code = http.StatusForbidden
+			}
+			writeError(w, code, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"from": from, "to": to})
+		return
+	}
+
+	writeError(w, http.StatusNotFound, "not_found")
+}
+
+// adminKey returns the admin credential to hand to the store. Requests may
+// either send the key itself in X-Admin-Key or, to avoid exposing it, send
+// X-Admin-Signature: hex(HMAC-SHA256(adminKey, body)). A valid signature
+// stands in for the key; an invalid one fails with bad_signature. The body
+// is left readable for the handler.
+func adminKey(r *http.Request) (string, error) {
+	sig := r.Header.Get("X-Admin-Signature")
+	if sig == "" {
+		return r.Header.Get("X-Admin-Key"), nil
+	}
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return "", fmt.Errorf("request_too_large")
+	}
+	if err != nil {
+		return "", fmt.Errorf("bad_signature")
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if verifyAdminSignature(st.adminKey, body, sig) {
+		return st.adminKey, nil
+	}
+	for key := range st.adminRoles {
+		if verifyAdminSignature(key, body, sig) {
+			return key, nil
+		}
+	}
+	return "", fmt.Errorf("bad_signature")
+}
+
+// requestUserID reads the acting user from the X-User-ID header, falling back
+// to a JSON body of the form {"user_id": 1}.
+func requestUserID(r *http.Request) (int64, error) {
+	if h := r.Header.Get("X-User-ID"); h != "" {
+		id, err := strconv.ParseInt(h, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad_user_id")
+		}
+		return id, nil
+	}
+	var body struct {
+		UserID int64 `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return 0, fmt.Errorf("missing_user_id")
+	}
+	return body.UserID, nil
+}
+
+// verifyAdminSignature checks sig, a hex HMAC-SHA256 of body under key, in
+// constant time.
+func verifyAdminSignature(key string, body []byte, sig string) bool {
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// queryCount reads a non-negative integer query param, returning def when
+// it is absent and ok=false when it is malformed.
+func queryCount(q url.Values, name string, def int) (int, bool) {
+	v := q.Get(name)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// queryTime reads an RFC 3339 query param, returning the zero time when it
+// is absent and ok=false when it is malformed.
+func queryTime(q url.Values, name string) (time.Time, bool) {
+	v := q.Get(name)
+	if v == "" {
+		return time.Time{}, true
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	return t, err == nil
+}
+
+// maxBodyBytes caps the JSON bodies read by decodeJSON.
+const maxBodyBytes = 16 << 10
+
+// maxImportBytes caps the CSV body of POST admin/games/import.
+const maxImportBytes = 1 << 20
+
+// wrongTypeError is returned by decodeJSON for a value of the wrong JSON
+// type, such as a string where a number belongs. field names it, dotted for
+// nested fields, when encoding/json can tell which it was.
+type wrongTypeError struct{ field string }
+
+func (e *wrongTypeError) Error() string { return "wrong_type" }
+
+// decodeJSON decodes r's JSON body into v. It fails with empty_body for no
+// body at all, malformed_json for one that isn't JSON, a *wrongTypeError for
+// a field of the wrong type, unknown_field for a field v doesn't have (so a
+// typo like "stakes" isn't silently read as 0) and request_too_large past
+// maxBodyBytes. A field's own UnmarshalJSON may fail with its own code, such
+// as bad_amount from Tokens.
+func decodeJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxBodyBytes))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	var (
+		tooLarge  *http.MaxBytesError
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, io.EOF):
+		return fmt.Errorf("empty_body")
+	case errors.As(err, &tooLarge):
+		return fmt.Errorf("request_too_large")
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("malformed_json")
+	case errors.As(err, &typeErr):
+		return &wrongTypeError{typeErr.Field}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return fmt.Errorf("unknown_field")
+	}
+	return err
+}
+
+// decodeBody is decodeJSON for handlers: on failure it writes the error
+// response, naming the field for wrong_type, and returns false.
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	// Capped here too so the server knows to close an oversized request.
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	err := decodeJSON(r, v)
+	if err == nil {
+		return true
+	}
+	var wrongType *wrongTypeError
+	switch {
+	case errors.As(err, &wrongType):
+		resp := map[string]string{"error": err.Error()}
+		if wrongType.field != "" {
+			resp["field"] = wrongType.field
+		}
+		writeJSON(w, http.StatusBadRequest, resp)
+	case err.Error() == "request_too_large":
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+	default:
+		writeError(w, http.StatusBadRequest, err.Error())
+	}
+	return false
+}
+
+// notModified sets tag as the response's ETag and, if the request's
+// If-None-Match already names it, answers 304 and returns true.
+func notModified(w http.ResponseWriter, r *http.Request, tag string) bool {
+	w.Header().Set("ETag", tag)
+	for _, t := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if t = strings.TrimSpace(t); t == tag || t == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// writeError sends {"error": errCode} so clients can parse failures the
+// same way as any other response.
+func writeError(w http.ResponseWriter, code int, errCode string) {
+	writeJSON(w, code, map[string]string{"error": errCode})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+// ---------------- live odds stream ----------------
+
+// subscribe registers a live odds stream for a game. The channel receives a
+// fresh copy of the game (odds included) after every change and is closed
+// once the game settles; cancel must be called when the listener goes away.
+func (s *store) subscribe(gameID int64) (<-chan *Game, func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g, ok := s.games[gameID]
+	if !ok {
+		return nil, nil, fmt.Errorf("game_not_found")
+	}
+	if g.closed() {
+		return nil, nil, fmt.Errorf("game_settled")
+	}
+	if len(s.subs[gameID]) >= s.maxSubscribers {
+		return nil, nil, fmt.Errorf("too_many_subscribers")
+	}
+	if s.subs[gameID] == nil {
+		s.subs[gameID] = map[chan *Game]struct{}{}
+	}
+	ch := make(chan *Game, 16)
+	s.subs[gameID][ch] = struct{}{}
+
+	ch <- s.gameView(g)
+
+	cancel := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.subs[gameID][ch]; ok {
+			delete(s.subs[gameID], ch)
+			close(ch)
+		}
+	}
+	return ch, cancel, nil
+}
+
+// publish pushes g's current odds to its subscribers. Slow subscribers miss
+// updates rather than stall the caller. Callers must hold s.mu.
+func (s *store) publish(g *Game) {
+	if len(s.subs[g.ID]) == 0 {
+		return
+	}
+	view := s.gameView(g)
+	for ch := range s.subs[g.ID] {
+		select {
+		case ch <- view:
+		default:
+		}
+	}
+}
 
-func Handler(w http.ResponseWriter, r *http.Request) {
-	// CORS + dispatch using the original path passed via rewrite (?path=...)
-	allowCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		rel := strings.TrimPrefix(r.URL.Query().Get("path"), "/") // e.g., "games", "games/101/bets"
-		switch {
-		case r.Method == http.MethodGet && (rel == "games" || rel == "games/"):
-			handleGames(w, r)
-			return
+// endStream sends the final state of g and closes its streams.
+// Callers must hold s.mu.
+func (s *store) endStream(g *Game) {
+	s.publish(g)
+	for ch := range s.subs[g.ID] {
+		close(ch)
+	}
+	delete(s.subs, g.ID)
+}
 
-		case strings.HasPrefix(rel, "games/"):
-			rest := strings.TrimPrefix(rel, "games/")
-			// handleGameByID expects URL.Path like /api/games/<rest>
-			r2 := r.Clone(r.Context())
-			r2.URL.Path = "/api/games/" + rest
-			handleGameByID(w, r2)
-			return
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
 
-		default:
-			http.NotFound(w, r)
+// serveOddsStream upgrades the request to a WebSocket (RFC 6455) and sends
+// the game as a JSON text message on every odds change until the game
+// settles or the client hangs up.
+func serveOddsStream(w http.ResponseWriter, r *http.Request, gameID int64) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		writeError(w, http.StatusBadRequest, "websocket_required")
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "websocket_unsupported")
+		return
+	}
+
+	updates, cancel, err := st.subscribe(gameID)
+	if err != nil {
+		code := http.StatusBadRequest
+		switch err.Error() {
+		case "game_not_found":
+			code = http.StatusNotFound
+		case "too_many_subscribers":
+			code = http.StatusServiceUnavailable
+		}
+		writeError(w, code, err.Error())
+		return
+	}
+	defer cancel()
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	// The reader only watches for pings and the client going away; all
+	// writes happen on this goroutine.
+	pings := make(chan []byte, 1)
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			op, payload, err := readWSFrame(rw.Reader)
+			if err != nil || op == wsOpClose {
+				return
+			}
+			if op == wsOpPing {
+				select {
+				case pings <- payload:
+				default:
+				}
+			}
+		}
+	}()
+
+	for {
+		select {
+		case g, ok := <-updates:
+			if !ok {
+				writeWSFrame(rw.Writer, wsOpClose, []byte{0x03, 0xe8}) // 1000: normal closure
+				return
+			}
+			msg, _ := json.Marshal(g)
+			if writeWSFrame(rw.Writer, wsOpText, msg) != nil {
+				return
+			}
+		case p := <-pings:
+			if writeWSFrame(rw.Writer, wsOpPong, p) != nil {
+				return
+			}
+		case <-gone:
 			return
 		}
-	})).ServeHTTP(w, r)
+	}
 }
 
-// ---------------- helpers & handlers ----------------
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xa
+)
 
-func allowCORS(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		origin := r.Header.Get("Origin")
-		if origin == "" {
-			origin = "*"
+// writeWSFrame writes a single unmasked, unfragmented frame.
+func writeWSFrame(w *bufio.Writer, op byte, payload []byte) error {
+	hdr := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		hdr = append(hdr, byte(n))
+	case n <= 0xffff:
+		hdr = append(hdr, 126)
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr = append(hdr, 127)
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// readWSFrame reads one client frame and unmasks its payload. Clients have
+// nothing to tell us, so anything larger than 4KB is treated as an error.
+func readWSFrame(r *bufio.Reader) (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	op := hdr[0] & 0x0f
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
 		}
-		w.Header().Set("Access-Control-Allow-Origin", origin)
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Admin-Key")
-		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > 4096 {
+		return 0, nil, errors.New("websocket: frame too large")
+	}
+	var mask [4]byte
+	masked := hdr[1]&0x80 != 0
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return op, payload, nil
+}
+
+// ---------------- rate limiting ----------------
+
+// rateLimiter is a per-client token bucket: each client may make up to
+// limit requests at once, refilled evenly over per.
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   float64
+	per     time.Duration
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limit int, per time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:   float64(limit),
+		per:     per,
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+}
+
+// allow takes a token from client's bucket if one is available. It also
+// reports how many whole tokens are left and how long until the bucket is
+// full again.
+func (l *rateLimiter) allow(client string) (ok bool, remaining int, reset time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	refill := l.limit / float64(l.per)
+	if len(l.buckets) > 10000 {
+		// forget clients whose buckets have refilled completely
+		for k, b := range l.buckets {
+			if b.tokens+float64(now.Sub(b.last))*refill >= l.limit {
+				delete(l.buckets, k)
+			}
+		}
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.limit, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = min(l.limit, b.tokens+float64(now.Sub(b.last))*refill)
+	b.last = now
+	ok = b.tokens >= 1
+	if ok {
+		b.tokens--
+	}
+	return ok, int(b.tokens), time.Duration((l.limit - b.tokens) / refill)
+}
+
+// middleware rejects requests over the limit with 429 rate_limited. Every
+// response carries the client's budget: X-RateLimit-Limit, -Remaining, and
+// -Reset, the seconds until the bucket is full again. A nil limiter lets
+// everything through.
+func (l *rateLimiter) middleware(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, remaining, reset := l.allow(clientIP(r))
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(int(l.limit)))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+		if !ok {
+			writeError(w, http.StatusTooManyRequests, "rate_limited")
 			return
 		}
 		next.ServeHTTP(w, r)
 	})
 }
 
-func handleGames(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodGet {
-		writeJSON(w, http.StatusOK, st.listGames())
-		return
+// clientIP prefers the first X-Forwarded-For hop, which is what Vercel's
+// proxy sets, and falls back to the connection's address.
+func clientIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		first, _, _ := strings.Cut(fwd, ",")
+		return strings.TrimSpace(first)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
 	}
-	http.Error(w, "method_not_allowed", http.StatusMethodNotAllowed)
+	return r.RemoteAddr
 }
 
-func handleGameByID(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/games/"), "/")
-	if len(parts) == 0 || parts[0] == "" {
-		http.NotFound(w, r)
+// ---------------- webhooks ----------------
+
+// webhookEvent is the JSON body POSTed to the webhook when a game settles
+// ("game.settled") or is voided ("game.voided", where the payouts are the
+// refunds and there is no result).
+type webhookEvent struct {
+	Event     string     `json:"event"`
+	GameID    int64      `json:"game_id"`
+	Result    *Selection `json:"result"`
+	HouseTake Tokens     `json:"house_take_tokens"`
+	Payouts   []payout   `json:"payouts"`
+}
+
+// webhooks delivers events to a single URL in the background, so a slow
+// receiver never holds up settlement. Each body is signed with the admin
+// key: X-Webhook-Signature is its hex HMAC-SHA256, as for admin requests.
+// Failed deliveries are retried with doubling backoff, then dropped.
+type webhooks struct {
+	mu       sync.Mutex
+	url      string
+	key      string
+	client   *http.Client
+	attempts int
+	backoff  time.Duration
+}
+
+func newWebhooks(target, key string) *webhooks {
+	return &webhooks{
+		url:      target,
+		key:      key,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		attempts: 3,
+		backoff:  time.Second,
+	}
+}
+
+func (h *webhooks) setURL(target string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.url = target
+}
+
+// send queues ev for delivery. It does nothing when no URL is set.
+func (h *webhooks) send(ev webhookEvent) {
+	h.mu.Lock()
+	target := h.url
+	h.mu.Unlock()
+	if target == "" {
 		return
 	}
-	id, err := strconv.ParseInt(parts[0], 10, 64)
+	body, err := json.Marshal(ev)
 	if err != nil {
-		http.Error(w, "bad_id", http.StatusBadRequest)
 		return
 	}
+	mac := hmac.New(sha256.New, []byte(h.key))
+	mac.Write(body)
+	sig := hex.EncodeToString(mac.Sum(nil))
 
-	if len(parts) == 1 && r.Method == http.MethodGet {
-		g, ok := st.getGame(id)
-		if !ok {
-			http.NotFound(w, r)
-			return
+	go func() {
+		wait := h.backoff
+		for attempt := 1; attempt <= h.attempts; attempt++ {
+			err := h.deliver(target, body, sig)
+			if err == nil {
+				return
+			}
+			if attempt == h.attempts {
+				log.Printf("webhook: giving up on %s for game %d: %v", ev.Event, ev.GameID, err)
+				return
+			}
+			time.Sleep(wait)
+			wait *= 2
 		}
-		writeJSON(w, http.StatusOK, g)
-		return
+	}()
+}
+
+func (h *webhooks) deliver(target string, body []byte, sig string) error {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Signature", sig)
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %d", resp.StatusCode)
 	}
+	return nil
+}
 
-	if len(parts) == 2 && parts[1] == "bets" && r.Method == http.MethodPost {
-		var body struct {
-			UserID    int64     `json:"user_id"`
-			Selection Selection `json:"selection"`
-			Stake     int64     `json:"stake"`
+// checkWebhookURL accepts absolute http and https URLs.
+func checkWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("bad_webhook_url")
+	}
+	return nil
+}
+
+// ---------------- tracing ----------------
+
+// tracer starts spans, each a child of any span already in ctx. The store
+// only sees this interface; otelTracer backs it with OpenTelemetry.
+type tracer interface {
+	Start(ctx context.Context, name string) (context.Context, span)
+}
+
+// span is one traced operation.
+type span interface {
+	SetAttr(key string, value any)
+	End()
+}
+
+// noopTracer is the tracer used when none is configured. Its spans do
+// nothing and ctx is passed through untouched.
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, _ string) (context.Context, span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttr(string, any) {}
+func (noopSpan) End()                {}
+
+// otelTracer is a tracer whose spans are OpenTelemetry spans from tp.
+// Serverless instances can be frozen between requests, so tp is flushed
+// whenever a root span ends rather than left to export in the background.
+type otelTracer struct {
+	tp *sdktrace.TracerProvider
+}
+
+// otlpTracer returns an otelTracer exporting over OTLP/HTTP to the
+// collector named by the standard OTEL_EXPORTER_OTLP_* variables.
+func otlpTracer() (otelTracer, error) {
+	exp, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		return otelTracer{}, err
+	}
+	return otelTracer{tp: sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp))}, nil
+}
+
+func (o otelTracer) Start(ctx context.Context, name string) (context.Context, span) {
+	root := !trace.SpanContextFromContext(ctx).IsValid()
+	ctx, sp := o.tp.Tracer("impredict").Start(ctx, name)
+	out := otelSpan{sp: sp}
+	if root {
+		out.tp = o.tp
+	}
+	return ctx, out
+}
+
+// otelSpan is a span from otelTracer. tp is set on root spans only.
+type otelSpan struct {
+	sp trace.Span
+	tp *sdktrace.TracerProvider
+}
+
+// SetAttr records value as an attribute of its own type where
+// OpenTelemetry has one, and as a string otherwise. An "error" attribute,
+// as set by endSpan, also marks the span failed.
+func (s otelSpan) SetAttr(key string, value any) {
+	var kv attribute.KeyValue
+	switch v := value.(type) {
+	case string:
+		kv = attribute.String(key, v)
+	case int:
+		kv = attribute.Int(key, v)
+	case int64:
+		kv = attribute.Int64(key, v)
+	case float64:
+		kv = attribute.Float64(key, v)
+	case bool:
+		kv = attribute.Bool(key, v)
+	default:
+		kv = attribute.String(key, fmt.Sprint(v))
+	}
+	s.sp.SetAttributes(kv)
+	if key == "error" {
+		s.sp.SetStatus(codes.Error, kv.Value.Emit())
+	}
+}
+
+func (s otelSpan) End() {
+	s.sp.End()
+	if s.tp != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := s.tp.ForceFlush(ctx); err != nil {
+			log.Printf("tracing: flush: %v", err)
 		}
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-			http.Error(w, "bad_json", http.StatusBadRequest)
-			return
+	}
+}
+
+// endSpan records err, if any, as the span's error code and ends it.
+func endSpan(sp span, err error) {
+	if err != nil {
+		sp.SetAttr("error", err.Error())
+	}
+	sp.End()
+}
+
+// withSpan runs each request in an "http.request" span, so the store's
+// spans for it become children.
+func withSpan(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, sp := st.tracer.Start(r.Context(), "http.request")
+		defer sp.End()
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			path = r.URL.Path
 		}
-		b, wlt, g, err := st.placeBet(body.UserID, id, body.Selection, body.Stake)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+		sp.SetAttr("http.method", r.Method)
+		sp.SetAttr("http.path", path)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		sp.SetAttr("http.status", rec.status)
+	})
+}
+
+// ---------------- request logging ----------------
+
+// accessLog writes one JSON object per line with no prefix, so the lines
+// can be parsed as they are.
+var accessLog = log.New(os.Stderr, "", 0)
+
+// withRequestLog tags each request with an ID, echoed in X-Request-ID, and
+// logs it once it completes.
+func withRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := randomKey()
+		w.Header().Set("X-Request-ID", id)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			path = r.URL.Path
 		}
+		line, _ := json.Marshal(struct {
+			Time       string  `json:"time"`
+			RequestID  string  `json:"request_id"`
+			Method     string  `json:"method"`
+			Path       string  `json:"path"`
+			Status     int     `json:"status"`
+			DurationMS float64 `json:"duration_ms"`
+		}{
+			Time:       start.UTC().Format(time.RFC3339Nano),
+			RequestID:  id,
+			Method:     r.Method,
+			Path:       path,
+			Status:     rec.status,
+			DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+		})
+		accessLog.Print(string(line))
+	})
+}
 
-		// >>> CHANGE #1: compute fresh odds in the response
-		gc := *g
-		addOdds(&gc)
-		writeJSON(w, http.StatusOK, map[string]any{"bet": b, "wallet": wlt, "game": &gc})
-		return
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Hijack passes through to the underlying writer so the odds stream can
+// still take over the connection.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijack_unsupported")
 	}
+	r.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
 
-	if len(parts) == 2 && parts[1] == "settle" && r.Method == http.MethodPost {
-		var body struct {
-			Result Selection `json:"result"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-			http.Error(w, "bad_json", http.StatusBadRequest)
+// ---------------- compression ----------------
+
+// gzipMinSize is the smallest response body withGzip compresses; below it
+// the gzip framing isn't worth the CPU.
+const gzipMinSize = 1024
+
+// withGzip gzips response bodies of at least gzipMinSize bytes for clients
+// that send Accept-Encoding: gzip.
+func withGzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
 			return
 		}
-		key := r.Header.Get("X-Admin-Key")
-		g, err := st.settle(key, id, body.Result)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusForbidden)
-			return
+		gw := &gzipWriter{ResponseWriter: w, status: http.StatusOK}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether r's Accept-Encoding allows gzip, i.e. lists
+// it (or *) without q=0.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(enc, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q=")
+		if !ok {
+			return true
 		}
+		if v, err := strconv.ParseFloat(q, 64); err == nil && v > 0 {
+			return true
+		}
+	}
+	return false
+}
 
-		// >>> CHANGE #2: compute fresh odds in the response
-		gc := *g
-		addOdds(&gc)
-		writeJSON(w, http.StatusOK, &gc)
+// gzipWriter holds back the status and the first gzipMinSize bytes of the
+// body to decide whether to compress. Bodies that stay smaller, responses
+// without one (204, 304) and ones already carrying a Content-Encoding are
+// sent as they are.
+type gzipWriter struct {
+	http.ResponseWriter
+	status   int
+	buf      []byte
+	gz       *gzip.Writer
+	started  bool // headers sent
+	hijacked bool
+}
+
+func (w *gzipWriter) WriteHeader(code int) {
+	if !w.started {
+		w.status = code
+	}
+}
+
+func (w *gzipWriter) Write(p []byte) (int, error) {
+	if w.started {
+		if w.gz != nil {
+			return w.gz.Write(p)
+		}
+		return w.ResponseWriter.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= gzipMinSize {
+		if err := w.start(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// start sends the headers, compressed if the body held back so far is big
+// enough, followed by that body.
+func (w *gzipWriter) start() error {
+	w.started = true
+	h := w.Header()
+	if len(w.buf) >= gzipMinSize && h.Get("Content-Encoding") == "" &&
+		w.status != http.StatusNoContent && w.status != http.StatusNotModified {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(w.buf)
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf)
+	}
+	w.buf = nil
+	return err
+}
+
+// close sends whatever is still held back and finishes the gzip stream.
+func (w *gzipWriter) close() {
+	if w.hijacked {
 		return
 	}
+	if !w.started {
+		w.start()
+	}
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
 
-	http.Error(w, "not_found", http.StatusNotFound)
+// Hijack passes through so the odds stream can take over the connection,
+// which leaves nothing for close to send.
+func (w *gzipWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijack_unsupported")
+	}
+	w.hijacked = true
+	return hj.Hijack()
 }
 
-func writeJSON(w http.ResponseWriter, code int, v any) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	enc := json.NewEncoder(w)
-	enc.SetIndent("", "  ")
-	_ = enc.Encode(v)
+// ---------------- OpenAPI ----------------
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, openAPIDoc())
+}
+
+// openAPIDoc describes every route dispatch serves as an OpenAPI 3.0
+// document. The paths are written out by hand and must change with the
+// handlers; the schemas are read off the Go types by jsonSchema.
+func openAPIDoc() map[string]any {
+	id := param("id", "path", "integer", "")
+	id["required"] = true
+	admin := param("X-Admin-Key", "header", "string", "The admin key; or sign the body with X-Admin-Signature")
+	userID := param("X-User-ID", "header", "integer", "When sent, must name the user acted for")
+	sender := param("X-User-ID", "header", "integer", "Must name the wallet's owner")
+	sender["required"] = true
+	oddsParams := []any{
+		param("odds_format", "query", "string", "decimal (default) or american"),
+		param("odds", "query", "string", "book (default, with the margin) or fair"),
+	}
+	oneGame := append([]any{id, param("user_id", "query", "integer", "Include this user's position as user")}, oddsParams...)
+
+	paths := map[string]any{
+		"/games": map[string]any{
+			"get": operation("List games, featured first, then by start time", append([]any{
+				param("ids", "query", "string", "Comma-separated game IDs to fetch instead of a page; the filters are ignored"),
+				param("sport", "query", "string", ""),
+				param("status", "query", "string", "PreGame, InProgress, Settled or Void; void games are left out unless asked for"),
+				param("from", "query", "string", "RFC 3339 start time lower bound"),
+				param("to", "query", "string", "RFC 3339 start time upper bound"),
+				param("limit", "query", "integer", ""),
+				param("offset", "query", "integer", ""),
+			}, oddsParams...), nil, map[string]any{
+				"200": reply("A page of games, or with ids the games found and the IDs missing", map[string]any{"oneOf": []any{
+					object(map[string]any{
+						"games":  arrayOf(ref("Game")),
+						"total":  map[string]any{"type": "integer"},
+						"limit":  map[string]any{"type": "integer"},
+						"offset": map[string]any{"type": "integer"},
+					}),
+					object(map[string]any{
+						"games":   arrayOf(ref("Game")),
+						"missing": arrayOf(map[string]any{"type": "integer"}),
+					}),
+				}}),
+				"304": map[string]any{"description": "Unchanged since If-None-Match"},
+			}),
+			"post": operation("Create a game", []any{admin}, ref("GameSpec"), map[string]any{
+				"201": reply("The new game", ref("Game")),
+			}),
+		},
+		"/games/{id}": map[string]any{
+			"get": operation("Get a game", oneGame, nil, map[string]any{
+				"200": reply("The game, with user when user_id is given", allOf(ref("Game"), object(map[string]any{
+					"user": ref("UserPosition"),
+				}))),
+				"304": map[string]any{"description": "Unchanged since If-None-Match"},
+			}),
+		},
+		"/games/{id}/bets": map[string]any{
+			"get": operation("List a game's bets; user_id is 0 unless the admin key is sent", []any{id, admin}, nil, map[string]any{
+				"200": reply("The bets", arrayOf(ref("Bet"))),
+			}),
+			"post": operation("Place a bet", []any{
+				id,
+				userID,
+				param("Idempotency-Key", "header", "string", "Replaying a key returns the original bet"),
+				param("X-Operator-Key", "header", "string", "Lets an operator bet for any user"),
+			}, ref("BetRequest"), map[string]any{
+				"200": reply("The bet, with the wallet and game after it", object(map[string]any{
+					"bet":    ref("Bet"),
+					"wallet": ref("Wallet"),
+					"game":   ref("Game"),
+				})),
+				"409": reply("idempotency_conflict or odds_moved", ref("Error")),
+				"422": reply("validation_failed, with a message per bad field", ref("Error")),
+			}),
+		},
+		"/games/{id}/quote": map[string]any{
+			"get": operation("Work out what a bet would pay if it won, without placing it", []any{
+				id,
+				param("selection", "query", "string", ""),
+				param("stake", "query", "number", ""),
+			}, nil, map[string]any{
+				"200": reply("The projected payout, and the game as it would be with the bet", ref("BetQuote")),
+				"409": reply("game_settled", ref("Error")),
+			}),
+		},
+		"/games/{id}/impact": map[string]any{
+			"get": operation("Show how a bet would move the odds of its market, without placing it", []any{
+				id,
+				param("selection", "query", "string", ""),
+				param("stake", "query", "number", ""),
+				param("odds", "query", "string", "book (default, with the margin) or fair"),
+			}, nil, map[string]any{
+				"200": reply("Each selection's odds before and after the bet", object(map[string]any{
+					"selection":    jsonSchema(reflect.TypeFor[Selection]()),
+					"stake_tokens": ref("Tokens"),
+					"odds":         arrayOf(ref("OddsMove")),
+				})),
+				"409": reply("game_settled", ref("Error")),
+			}),
+		},
+		"/games/{id}/settle": map[string]any{
+			"post": operation("Settle a game from its result or final score", []any{
+				id,
+				admin,
+				param("dry_run", "query", "boolean", "Work out the payouts without settling"),
+				param("force", "query", "boolean", "Correct the result of a settled game"),
+			}, ref("SettleRequest"), map[string]any{
+				"200": reply("The settled game, or the payouts on a dry run", map[string]any{"oneOf": []any{
+					allOf(ref("Game"), object(map[string]any{
+						"house_take_tokens":          ref("Tokens"),
+						"voided_insufficient_action": map[string]any{"type": "boolean"},
+						"pushed":                     map[string]any{"type": "boolean"},
+					})),
+					object(map[string]any{
+						"dry_run":                    map[string]any{"type": "boolean"},
+						"payouts":                    arrayOf(ref("Payout")),
+						"house_take_tokens":          ref("Tokens"),
+						"voided_insufficient_action": map[string]any{"type": "boolean"},
+						"pushed":                     map[string]any{"type": "boolean"},
+					}),
+				}}),
+				"409": reply("not_settled or cannot_resettle", ref("Error")),
+			}),
+		},
+		"/games/{id}/void": map[string]any{
+			"post": operation("Void a game, refunding every bet", []any{id, admin}, nil, map[string]any{
+				"200": reply("The voided game and its refunds", object(map[string]any{
+					"game":              ref("Game"),
+					"refunded_user_ids": arrayOf(map[string]any{"type": "integer"}),
+					"refunded_tokens":   ref("Tokens"),
+				})),
+			}),
+		},
+		"/games/{id}/reopen": map[string]any{
+			"post": operation("Undo a void, taking the refunds back", []any{id, admin}, nil, map[string]any{
+				"200": reply("The reopened game", ref("Game")),
+				"409": reply("not_voided, or cannot_reopen with short_user_ids", ref("Error")),
+			}),
+		},
+		"/games/{id}/suspend": map[string]any{
+			"post": operation("Suspend betting on a game", []any{id, admin}, nil, map[string]any{
+				"200": reply("The game", ref("Game")),
+			}),
+		},
+		"/games/{id}/resume": map[string]any{
+			"post": operation("Resume betting on a game", []any{id, admin}, nil, map[string]any{
+				"200": reply("The game", ref("Game")),
+			}),
+		},
+		"/betslip": map[string]any{
+			"post": operation("Place several bets, all or none", []any{userID}, ref("SlipRequest"), map[string]any{
+				"200": reply("The bets and the wallet after them", object(map[string]any{
+					"bets":   arrayOf(ref("Bet")),
+					"wallet": ref("Wallet"),
+				})),
+				"422": reply("slip_rejected, with the failures by index", ref("Error")),
+			}),
+		},
+		"/bets/{id}": map[string]any{
+			"get": operation("Get a bet", []any{id}, nil, map[string]any{
+				"200": reply("The bet", allOf(ref("Bet"), object(map[string]any{
+					"settled": map[string]any{"type": "boolean"},
+				}))),
+			}),
+			"delete": operation("Cancel a bet while its game is open for betting", []any{id, userID}, nil, map[string]any{
+				"200": reply("The wallet after the refund", object(map[string]any{"wallet": ref("Wallet")})),
+			}),
+		},
+		"/bets/{id}/cashout": map[string]any{
+			"post": operation("Cash out some or all of a bet", []any{id}, ref("CashOutRequest"), map[string]any{
+				"200": reply("The bet, or null if fully cashed out, and the wallet", object(map[string]any{
+					"bet":               ref("Bet"),
+					"wallet":            ref("Wallet"),
+					"cashed_out_tokens": ref("Tokens"),
+				})),
+			}),
+		},
+		"/wallets/{id}": map[string]any{
+			"get": operation("Get a wallet", []any{id}, nil, map[string]any{
+				"200": reply("The wallet", ref("Wallet")),
+			}),
+		},
+		"/wallets/{id}/deposit": map[string]any{
+			"post": operation("Deposit into a wallet", []any{id}, ref("DepositRequest"), map[string]any{
+				"200": reply("The wallet", ref("Wallet")),
+			}),
+		},
+		"/wallets/{id}/transfer": map[string]any{
+			"post": operation("Transfer to another wallet", []any{id, sender}, ref("TransferRequest"), map[string]any{
+				"200": reply("Both wallets", object(map[string]any{
+					"from": ref("Wallet"),
+					"to":   ref("Wallet"),
+				})),
+				"401": reply("unauthenticated: X-User-ID not sent", ref("Error")),
+				"403": reply("forbidden: X-User-ID names someone else", ref("Error")),
+				"409": reply("insufficient_balance", ref("Error")),
+			}),
+		},
+		"/games/{id}/stream": map[string]any{
+			"get": operation("Stream the game over a WebSocket after every odds change until it settles", []any{id}, nil, map[string]any{
+				"101": map[string]any{"description": "Switched to a WebSocket carrying the game as JSON text messages"},
+				"503": reply("too_many_subscribers", ref("Error")),
+			}),
+		},
+		"/users/{id}/bets": map[string]any{
+			"get": operation("List a user's bets", []any{
+				id,
+				param("game_id", "query", "integer", "Only bets on this game"),
+				param("status", "query", "string", "Only bets on games with this status"),
+			}, nil, map[string]any{
+				"200": reply("The bets", arrayOf(ref("Bet"))),
+				"404": reply("not_found", ref("Error")),
+			}),
+		},
+		"/users/{id}/games": map[string]any{
+			"get": operation("List the open games a user has bets on", []any{id}, nil, map[string]any{
+				"200": reply("The games, each with the user's stake", arrayOf(allOf(ref("Game"), object(map[string]any{
+					"my_stake_tokens": ref("Tokens"),
+					"my_selections":   arrayOf(jsonSchema(reflect.TypeFor[Selection]())),
+				})))),
+				"404": reply("not_found", ref("Error")),
+			}),
+		},
+		"/users/{id}/stats": map[string]any{
+			"get": operation("Summarise a user's betting record", []any{id}, nil, map[string]any{
+				"200": reply("The user's record", ref("UserStats")),
+				"404": reply("not_found", ref("Error")),
+			}),
+		},
+		"/leaderboard": map[string]any{
+			"get": operation("List the richest wallets", []any{param("limit", "query", "integer", "")}, nil, map[string]any{
+				"200": reply("The wallets, richest first", arrayOf(object(map[string]any{
+					"rank":           map[string]any{"type": "integer"},
+					"user_id":        map[string]any{"type": "integer"},
+					"tokens_balance": ref("Tokens"),
+				}))),
+			}),
+		},
+		"/results": map[string]any{
+			"get": operation("List settled games, most recent first", []any{param("sport", "query", "string", "")}, nil, map[string]any{
+				"200": reply("The games", arrayOf(ref("Game"))),
+				"304": map[string]any{"description": "Unchanged since If-None-Match"},
+			}),
+		},
+		"/openapi.json": map[string]any{
+			"get": operation("This document", nil, nil, map[string]any{
+				"200": map[string]any{"description": "The OpenAPI document"},
+			}),
+		},
+		"/healthz": map[string]any{
+			"get": operation("Check the instance is up", nil, nil, map[string]any{
+				"200": reply("Counts of games, bets and tokens", ref("StoreStats")),
+			}),
+		},
+		"/metrics": map[string]any{
+			"get": operation("Counters in the Prometheus text format", nil, nil, map[string]any{
+				"200": map[string]any{
+					"description": "The counters",
+					"content":     map[string]any{"text/plain": map[string]any{"schema": map[string]any{"type": "string"}}},
+				},
+			}),
+		},
+		"/admin/audit": map[string]any{
+			"get": operation("Check that no tokens have leaked", []any{admin}, nil, map[string]any{
+				"200": reply("The token accounting, with error set on a leak", object(map[string]any{
+					"report": ref("AuditReport"),
+					"error":  map[string]any{"type": "string"},
+				})),
+			}),
+		},
+		"/admin/reconcile": map[string]any{
+			"get": operation("Recompute settled payouts and list any that differ", []any{admin}, nil, map[string]any{
+				"200": reply("The mismatches", ref("ReconcileReport")),
+			}),
+		},
+		"/admin/audit-log": map[string]any{
+			"get": operation("List admin actions on wallets", []any{admin}, nil, map[string]any{
+				"200": reply("The entries, oldest first", object(map[string]any{"entries": arrayOf(ref("AuditEntry"))})),
+			}),
+		},
+		"/admin/wallets/{id}/adjust": map[string]any{
+			"post": operation("Credit or debit a wallet", []any{id, admin}, ref("AdjustRequest"), map[string]any{
+				"200": reply("The wallet", ref("Wallet")),
+				"409": reply("negative_balance", ref("Error")),
+			}),
+		},
+		"/admin/users/{id}/suspend": map[string]any{
+			"post": operation("Suspend a user, or lift the suspension", []any{id, admin}, ref("SuspendRequest"), map[string]any{
+				"200": reply("The wallet", ref("Wallet")),
+			}),
+		},
+		"/admin/webhook": map[string]any{
+			"post": operation("Set or clear the webhook URL", []any{admin}, ref("WebhookRequest"), map[string]any{
+				"200": reply("The URL now in use", ref("WebhookRequest")),
+			}),
+		},
+		"/admin/settle-batch": map[string]any{
+			"post": operation("Settle several games by ID", []any{admin}, ref("SettleBatchRequest"), map[string]any{
+				"200": reply("What happened to each game", ref("BatchSummary")),
+			}),
+		},
+		"/admin/games/{id}/feature": map[string]any{
+			"post": operation("Feature a game at a rank, or unfeature it with 0", []any{id, admin}, ref("FeatureRequest"), map[string]any{
+				"200": reply("The game", ref("Game")),
+			}),
+		},
+		"/admin/games/{id}/clone": map[string]any{
+			"post": operation("Create a game like another at a new start time", []any{id, admin}, ref("CloneRequest"), map[string]any{
+				"201": reply("The new game", ref("Game")),
+			}),
+		},
+		"/admin/games/import": map[string]any{
+			"post": map[string]any{
+				"summary":    "Create games from CSV rows of sport, home, away and start time",
+				"parameters": []any{admin},
+				"requestBody": map[string]any{
+					"required": true,
+					"content":  map[string]any{"text/csv": map[string]any{"schema": map[string]any{"type": "string"}}},
+				},
+				"responses": map[string]any{
+					"200": reply("The outcome of each row", object(map[string]any{
+						"created": map[string]any{"type": "integer"},
+						"failed":  map[string]any{"type": "integer"},
+						"rows":    arrayOf(ref("ImportRow")),
+					})),
+					"400": reply("bad_csv", ref("Error")),
+					"413": reply("request_too_large", ref("Error")),
+				},
+			},
+		},
+	}
+
+	schemas := map[string]any{
+		"Tokens": jsonSchema(reflect.TypeFor[Tokens]()),
+		"Error": object(map[string]any{
+			"error":          map[string]any{"type": "string"},
+			"field":          map[string]any{"type": "string"},
+			"fields":         map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "string"}},
+			"short_user_ids": arrayOf(map[string]any{"type": "integer"}),
+			"failed": arrayOf(object(map[string]any{
+				"index": map[string]any{"type": "integer"},
+				"error": map[string]any{"type": "string"},
+			})),
+		}),
+	}
+	for name, v := range map[string]any{
+		"Game":            Game{},
+		"Bet":             Bet{},
+		"Wallet":          Wallet{},
+		"Payout":          payout{},
+		"BetQuote":        betQuote{},
+		"OddsMove":        oddsMove{},
+		"UserPosition":    userPosition{},
+		"GameSpec":        gameSpec{},
+		"BetRequest":      betRequest{},
+		"SettleRequest":   settleRequest{},
+		"SlipRequest":     slipRequest{},
+		"CashOutRequest":  cashOutRequest{},
+		"DepositRequest":  depositRequest{},
+		"TransferRequest": transferRequest{},
+
+		"UserStats":          statsReport{},
+		"StoreStats":         storeStats{},
+		"AuditReport":        auditReport{},
+		"ReconcileReport":    reconcileReport{},
+		"AuditEntry":         auditEntry{},
+		"BatchSummary":       batchSummary{},
+		"ImportRow":          importRow{},
+		"AdjustRequest":      adjustRequest{},
+		"SuspendRequest":     suspendRequest{},
+		"WebhookRequest":     webhookRequest{},
+		"SettleBatchRequest": settleBatchRequest{},
+		"FeatureRequest":     featureRequest{},
+		"CloneRequest":       cloneRequest{},
+	} {
+		schemas[name] = jsonSchema(reflect.TypeOf(v))
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "bet me if you can",
+			"version":     "1",
+			"description": "Token amounts are decimals with up to three places. Games without a draw market leave out their draw fields.",
+		},
+		"servers":    []any{map[string]any{"url": "/api"}},
+		"paths":      paths,
+		"components": map[string]any{"schemas": schemas},
+	}
+}
+
+// jsonSchema describes how encoding/json reads and writes a value of type t.
+func jsonSchema(t reflect.Type) map[string]any {
+	switch t {
+	case reflect.TypeFor[Tokens]():
+		return map[string]any{"type": "number", "description": "Tokens, to at most three decimal places"}
+	case reflect.TypeFor[stringOrNumber]():
+		return map[string]any{"oneOf": []any{map[string]any{"type": "string"}, map[string]any{"type": "number"}}}
+	case reflect.TypeFor[Selection]():
+		return map[string]any{"type": "string", "enum": []Selection{SelHome, SelAway, SelDraw, SelOver, SelUnder}}
+	case reflect.TypeFor[GameStatus]():
+		return map[string]any{"type": "string", "enum": []GameStatus{StatusPre, StatusLive, StatusDone, StatusVoid}}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := jsonSchema(t.Elem())
+		s["nullable"] = true
+		return s
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice:
+		return arrayOf(jsonSchema(t.Elem()))
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		props := map[string]any{}
+		for i := range t.NumField() {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if !f.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = jsonSchema(f.Type)
+		}
+		return object(props)
+	}
+	return map[string]any{}
+}
+
+func operation(summary string, params []any, body any, responses map[string]any) map[string]any {
+	op := map[string]any{"summary": summary, "responses": responses}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	if body != nil {
+		op["requestBody"] = map[string]any{
+			"required": true,
+			"content":  map[string]any{"application/json": map[string]any{"schema": body}},
+		}
+	}
+	if _, ok := responses["400"]; !ok {
+		responses["400"] = reply("The error code says what was wrong", ref("Error"))
+	}
+	return op
+}
+
+func param(name, in, typ, description string) map[string]any {
+	p := map[string]any{"name": name, "in": in, "schema": map[string]any{"type": typ}}
+	if description != "" {
+		p["description"] = description
+	}
+	return p
+}
+
+func reply(description string, schema any) map[string]any {
+	return map[string]any{
+		"description": description,
+		"content":     map[string]any{"application/json": map[string]any{"schema": schema}},
+	}
+}
+
+func ref(name string) map[string]any {
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+func object(props map[string]any) map[string]any {
+	return map[string]any{"type": "object", "properties": props}
+}
+
+func arrayOf(items any) map[string]any {
+	return map[string]any{"type": "array", "items": items}
+}
+
+func allOf(schemas ...any) map[string]any {
+	return map[string]any{"allOf": schemas}
 }
@@ -25,12 +25,12 @@ type alias Game =
     , away : String
     , start_time : String
     , status : String
-    , home_pool_tokens : Int
-    , away_pool_tokens : Int
-    , draw_pool_tokens : Int
-    , home_odds : Float
-    , away_odds : Float
-    , draw_odds : Float
+    , home_pool_tokens : Float
+    , away_pool_tokens : Float
+    , draw_pool_tokens : Float
+    , home_prob : Float
+    , away_prob : Float
+    , draw_prob : Float
     }
 
 type Page
@@ -115,14 +115,12 @@ update msg model =
             case ( model.page, model.selected ) of
                 ( DetailPage gid, Just _ ) ->
                     let
-                        stakeInt =
-                            String.toInt model.stake |> Maybe.withDefault 0
-
                         body =
                             E.object
                                 [ ( "user_id", E.int model.userId )
                                 , ( "selection", E.string model.selection )
-                                , ( "stake", E.int stakeInt )
+                                -- sent as a decimal string so fractional stakes stay exact
+                                , ( "stake", E.string (String.trim model.stake) )
                                 ]
                     in
                     ( model
@@ -163,7 +161,7 @@ fetchGames : Cmd Msg
 fetchGames =
     Http.get
         { url = apiBase ++ "/api/games"
-        , expect = Http.expectJson GotGames (D.list gameDecoder)
+        , expect = Http.expectJson GotGames (D.field "games" (D.list gameDecoder))
         }
 
 fetchGame : Int -> Cmd Msg
@@ -190,9 +188,9 @@ gameDecoder =
             , home_pool_tokens = 0
             , away_pool_tokens = 0
             , draw_pool_tokens = 0
-            , home_odds = 0
-            , away_odds = 0
-            , draw_odds = 0
+            , home_prob = 0
+            , away_prob = 0
+            , draw_prob = 0
             }
         )
         (D.field "id" D.int)
@@ -210,19 +208,26 @@ gameDecoder =
                             | home_pool_tokens = hp
                             , away_pool_tokens = ap
                             , draw_pool_tokens = dp
-                            , home_odds = ho
-                            , away_odds = ao
-                            , draw_odds = d0
+                            , home_prob = ho
+                            , away_prob = ao
+                            , draw_prob = d0
                         }
                     )
-                    (D.field "home_pool_tokens" D.int)
-                    (D.field "away_pool_tokens" D.int)
-                    (D.field "draw_pool_tokens" D.int)
-                    (D.field "home_odds" D.float)
-                    (D.field "away_odds" D.float)
-                    (D.field "draw_odds" D.float)
+                    (D.field "home_pool_tokens" D.float)
+                    (D.field "away_pool_tokens" D.float)
+                    (optionalField "draw_pool_tokens" D.float 0)
+                    (D.field "home_prob" D.float)
+                    (D.field "away_prob" D.float)
+                    (optionalField "draw_prob" D.float 0)
             )
-    
+
+
+-- games without a draw market leave the draw fields out
+optionalField : String -> D.Decoder a -> a -> D.Decoder a
+optionalField name decoder fallback =
+    D.oneOf [ D.field name decoder, D.succeed fallback ]
+
+
 betResponseDecoder : D.Decoder Game
 betResponseDecoder =
     D.field "game" gameDecoder
@@ -267,13 +272,13 @@ viewList games =
             , div [ class "muted" ] [ text ("starts: " ++ g.start_time) ]
             , div [ class "muted" ] [ text ("status: " ++ String.toLower g.status) ]
             , div [] [ text ("pools h/a/d: "
-                ++ String.fromInt g.home_pool_tokens ++ " / "
-                ++ String.fromInt g.away_pool_tokens ++ " / "
-                ++ String.fromInt g.draw_pool_tokens) ]
+                ++ String.fromFloat g.home_pool_tokens ++ " / "
+                ++ String.fromFloat g.away_pool_tokens ++ " / "
+                ++ String.fromFloat g.draw_pool_tokens) ]
             , div [] [ text ("implied odds h/a/d: "
-                ++ pct g.home_odds ++ " / "
-                ++ pct g.away_odds ++ " / "
-                ++ pct g.draw_odds) ]
+                ++ pct g.home_prob ++ " / "
+                ++ pct g.away_prob ++ " / "
+                ++ pct g.draw_prob) ]
             , button [ onClick (GoDetail g.id), style "margin-top" "6px", class "button" ] [ text "open" ]
             ]
                 )
@@ -294,13 +299,13 @@ viewDetail gid model =
                 , h3 [] [ text (g.sport ++ ": " ++ g.home ++ " vs " ++ g.away) ]
                 , div [ class "muted" ] [ text ("status: " ++ String.toLower g.status) ]
                 , div [] [ text ("pools h/a/d: "
-                        ++ String.fromInt g.home_pool_tokens ++ " / "
-                        ++ String.fromInt g.away_pool_tokens ++ " / "
-                        ++ String.fromInt g.draw_pool_tokens) ]
+                        ++ String.fromFloat g.home_pool_tokens ++ " / "
+                        ++ String.fromFloat g.away_pool_tokens ++ " / "
+                        ++ String.fromFloat g.draw_pool_tokens) ]
                 , div [] [ text ("implied odds h/a/d: "
-                        ++ pct g.home_odds ++ " / "
-                        ++ pct g.away_odds ++ " / "
-                        ++ pct g.draw_odds) ]
+                        ++ pct g.home_prob ++ " / "
+                        ++ pct g.away_prob ++ " / "
+                        ++ pct g.draw_prob) ]
                 , div [ style "margin-top" "10px" ]
                     [ label [] [ text "pick" ]
                     , select [ onInput SetSelection, style "margin-left" "6px" ]